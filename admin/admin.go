@@ -0,0 +1,323 @@
+/*
+Package admin provides an HTTP handler for inspecting and controlling parties.
+
+	GET  /                  All parties
+	GET  /{party}           A party and its users
+	POST /{party}/broadcast Broadcast a message, {"event": "...", "payload": ...}
+	POST /{party}/kick      Kick a user, {"user_id": "...", "reason": "..."}
+	POST /{party}/end       End the party, {"reason": "..."}
+
+Parties are found by their names. Mount the handler under a prefix with http.StripPrefix,
+and never expose it without an authorizer that checks who's asking.
+*/
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/izzymg/sockparty"
+)
+
+// Errors returned when adding parties.
+var (
+	ErrNoName        = errors.New("Party has no name")
+	ErrDuplicateName = errors.New("A party with that name was already added")
+)
+
+// Authorizer returns true if the request is allowed to use the admin handler.
+type Authorizer func(req *http.Request) bool
+
+// BearerToken returns an authorizer which allows requests with the token as their bearer token.
+func BearerToken(token string) Authorizer {
+	return func(req *http.Request) bool {
+		header := req.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			return false
+		}
+		return subtle.ConstantTimeCompare([]byte(header[len("Bearer "):]), []byte(token)) == 1
+	}
+}
+
+// PartyInfo describes a party.
+type PartyInfo struct {
+	Name      string          `json:"name"`
+	UserCount int             `json:"user_count"`
+	Uptime    float64         `json:"uptime"` // Seconds
+	Stats     sockparty.Stats `json:"stats"`
+	// Average messages per second over the party's uptime.
+	ReceivedRate float64 `json:"received_rate"`
+	SentRate     float64 `json:"sent_rate"`
+	// Only listed for a single party.
+	Users []UserInfo `json:"users,omitempty"`
+}
+
+// UserInfo describes a user in a party.
+type UserInfo struct {
+	ID          string            `json:"id"`
+	Name        string            `json:"name,omitempty"`
+	Roles       []sockparty.Role  `json:"roles"`
+	Subprotocol string            `json:"subprotocol,omitempty"`
+	Joined      time.Time         `json:"joined"`
+	Latency     sockparty.Latency `json:"latency"`
+	Compression float64           `json:"compression_ratio"`
+}
+
+// Handler serves the admin API for its parties.
+type Handler struct {
+	authorize Authorizer
+	parties   map[string]*sockparty.Party
+	mut       sync.RWMutex
+}
+
+/*
+New creates an admin handler for the parties. Requests are only served if the authorizer
+allows them, a nil authorizer rejects all requests.
+*/
+func New(authorize Authorizer, parties ...*sockparty.Party) (*Handler, error) {
+	h := &Handler{
+		authorize: authorize,
+		parties:   make(map[string]*sockparty.Party),
+	}
+	for _, party := range parties {
+		err := h.Add(party)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// Add adds a party to the handler by its name, which must be unique.
+func (h *Handler) Add(party *sockparty.Party) error {
+	if party.Name == "" {
+		return ErrNoName
+	}
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	if _, ok := h.parties[party.Name]; ok {
+		return fmt.Errorf("%w: %q", ErrDuplicateName, party.Name)
+	}
+	h.parties[party.Name] = party
+	return nil
+}
+
+// Remove removes a party from the handler by its name.
+func (h *Handler) Remove(name string) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	delete(h.parties, name)
+}
+
+func (h *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if h.authorize == nil || !h.authorize(req) {
+		writeError(rw, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	path := strings.Trim(req.URL.EscapedPath(), "/")
+	if path == "" {
+		if req.Method != http.MethodGet {
+			writeError(rw, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		h.list(rw)
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	if len(parts) > 2 {
+		writeError(rw, http.StatusNotFound, "Not found")
+		return
+	}
+	name, err := url.PathUnescape(parts[0])
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, "Invalid party name")
+		return
+	}
+	h.mut.RLock()
+	party, ok := h.parties[name]
+	h.mut.RUnlock()
+	if !ok {
+		writeError(rw, http.StatusNotFound, "No such party")
+		return
+	}
+
+	action := ""
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+	if action == "" {
+		if req.Method != http.MethodGet {
+			writeError(rw, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		writeJSON(rw, http.StatusOK, describe(party, true))
+		return
+	}
+	if req.Method != http.MethodPost {
+		writeError(rw, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	switch action {
+	case "broadcast":
+		h.broadcast(rw, req, party)
+	case "kick":
+		h.kick(rw, req, party)
+	case "end":
+		h.end(rw, req, party)
+	default:
+		writeError(rw, http.StatusNotFound, "Not found")
+	}
+}
+
+// List all parties, in order of name.
+func (h *Handler) list(rw http.ResponseWriter) {
+	h.mut.RLock()
+	parties := make([]PartyInfo, 0, len(h.parties))
+	for _, party := range h.parties {
+		parties = append(parties, describe(party, false))
+	}
+	h.mut.RUnlock()
+	sort.Slice(parties, func(i, j int) bool {
+		return parties[i].Name < parties[j].Name
+	})
+	writeJSON(rw, http.StatusOK, parties)
+}
+
+func (h *Handler) broadcast(rw http.ResponseWriter, req *http.Request, party *sockparty.Party) {
+	var body struct {
+		Event   sockparty.Event `json:"event"`
+		Payload json.RawMessage `json:"payload"`
+	}
+	if !readJSON(rw, req, &body) {
+		return
+	}
+	if body.Event == "" {
+		writeError(rw, http.StatusBadRequest, "Missing event")
+		return
+	}
+	message := &sockparty.Outgoing{Event: body.Event}
+	if len(body.Payload) > 0 {
+		message.Payload = body.Payload
+	}
+	err := party.Broadcast(req.Context(), message)
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) kick(rw http.ResponseWriter, req *http.Request, party *sockparty.Party) {
+	var body struct {
+		UserID string `json:"user_id"`
+		Reason string `json:"reason"`
+	}
+	if !readJSON(rw, req, &body) {
+		return
+	}
+	err := party.Kick(body.UserID, body.Reason)
+	if errors.Is(err, sockparty.ErrReasonTooLong) {
+		writeError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	if errors.Is(err, sockparty.ErrNoSuchUser) {
+		writeError(rw, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) end(rw http.ResponseWriter, req *http.Request, party *sockparty.Party) {
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if !readJSON(rw, req, &body) {
+		return
+	}
+	if len(body.Reason) > sockparty.MaxCloseReason {
+		writeError(rw, http.StatusBadRequest, sockparty.ErrReasonTooLong.Error())
+		return
+	}
+	party.End(body.Reason)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// Describe a party, optionally listing its users.
+func describe(party *sockparty.Party, withUsers bool) PartyInfo {
+	uptime := party.Uptime().Seconds()
+	stats := party.Stats()
+	info := PartyInfo{
+		Name:      party.Name,
+		UserCount: party.GetConnectedUserCount(),
+		Uptime:    uptime,
+		Stats:     stats,
+	}
+	if uptime > 0 {
+		info.ReceivedRate = float64(stats.Received) / uptime
+		info.SentRate = float64(stats.Sent) / uptime
+	}
+	if !withUsers {
+		return info
+	}
+
+	info.Users = []UserInfo{}
+	for _, id := range party.GetConnectedUserIDs() {
+		usr, err := party.GetUser(id)
+		if err != nil {
+			// Left since listed.
+			continue
+		}
+		info.Users = append(info.Users, UserInfo{
+			ID:          usr.ID,
+			Name:        usr.Name,
+			Roles:       usr.Roles(),
+			Subprotocol: usr.Subprotocol(),
+			Joined:      usr.Joined(),
+			Latency:     usr.Latency(),
+			Compression: usr.Compression().Ratio(),
+		})
+	}
+	sort.Slice(info.Users, func(i, j int) bool {
+		return info.Users[i].Joined.Before(info.Users[j].Joined)
+	})
+	return info
+}
+
+// Maximum size of a request body.
+const maxBody = 1 << 20
+
+// Read the request's JSON body, writing an error and returning false if it's invalid.
+func readJSON(rw http.ResponseWriter, req *http.Request, v interface{}) bool {
+	err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, maxBody)).Decode(v)
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, fmt.Sprintf("Invalid JSON body: %v", err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(v)
+}
+
+func writeError(rw http.ResponseWriter, status int, message string) {
+	writeJSON(rw, status, struct {
+		Error string `json:"error"`
+	}{message})
+}
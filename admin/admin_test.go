@@ -0,0 +1,150 @@
+package admin_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+
+	"github.com/izzymg/sockparty"
+	"github.com/izzymg/sockparty/admin"
+	"github.com/izzymg/sockparty/sockpartytest"
+)
+
+const token = "secret"
+
+func newParty(name string) *sockparty.Party {
+	party := sockparty.New(sockpartytest.SequentialIDs(name), &sockparty.Options{
+		PingFrequency: 0,
+	})
+	party.Name = name
+	return party
+}
+
+// Make an authorized request to the handler.
+func request(h http.Handler, method string, path string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	return rw
+}
+
+// Test parties and their users are listed.
+func TestInspect(t *testing.T) {
+	is := is.New(t)
+
+	lobby := newParty("lobby")
+	cinema := newParty("cinema")
+	h, err := admin.New(admin.BearerToken(token), lobby, cinema)
+	is.NoErr(err)
+
+	recorder := sockpartytest.Record(cinema)
+	defer recorder.Stop()
+	c, err := sockpartytest.Dial(cinema)
+	is.NoErr(err)
+	defer c.Close()
+	_, err = recorder.ExpectJoin()
+	is.NoErr(err)
+	is.NoErr(c.Send("chat_message", "hi"))
+	_, err = recorder.ExpectIncoming()
+	is.NoErr(err)
+
+	rw := request(h, http.MethodGet, "/", "")
+	is.Equal(rw.Code, http.StatusOK)
+	var parties []admin.PartyInfo
+	is.NoErr(json.NewDecoder(rw.Body).Decode(&parties))
+	is.Equal(len(parties), 2)
+	is.Equal(parties[0].Name, "cinema")
+	is.Equal(parties[0].UserCount, 1)
+	is.Equal(parties[0].Stats.Received, uint64(1))
+	is.True(parties[0].Users == nil)
+	is.Equal(parties[1].Name, "lobby")
+	is.Equal(parties[1].UserCount, 0)
+
+	rw = request(h, http.MethodGet, "/cinema", "")
+	is.Equal(rw.Code, http.StatusOK)
+	var party admin.PartyInfo
+	is.NoErr(json.NewDecoder(rw.Body).Decode(&party))
+	is.Equal(len(party.Users), 1)
+	is.Equal(party.Users[0].ID, "cinema1")
+
+	rw = request(h, http.MethodGet, "/nightclub", "")
+	is.Equal(rw.Code, http.StatusNotFound)
+
+	// Unauthorized requests are rejected.
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer guess")
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	is.Equal(rw.Code, http.StatusUnauthorized)
+
+	// Party names are unique.
+	is.True(errors.Is(h.Add(newParty("lobby")), admin.ErrDuplicateName))
+	is.True(errors.Is(h.Add(newParty("")), admin.ErrNoName))
+}
+
+// Test parties are controlled with actions.
+func TestActions(t *testing.T) {
+	is := is.New(t)
+
+	party := newParty("lobby")
+	h, err := admin.New(admin.BearerToken(token), party)
+	is.NoErr(err)
+	recorder := sockpartytest.Record(party)
+	defer recorder.Stop()
+
+	dial := func() *sockpartytest.Client {
+		c, err := sockpartytest.Dial(party)
+		is.NoErr(err)
+		_, err = recorder.ExpectJoin()
+		is.NoErr(err)
+		return c
+	}
+	first := dial()
+	defer first.Close()
+	second := dial()
+	defer second.Close()
+
+	rw := request(h, http.MethodPost, "/lobby/broadcast", `{"event": "announcement", "payload": "Closing soon"}`)
+	is.Equal(rw.Code, http.StatusNoContent)
+	for _, c := range []*sockpartytest.Client{first, second} {
+		message, err := c.Expect("announcement")
+		is.NoErr(err)
+		is.Equal(string(message.Payload), `"Closing soon"`)
+	}
+
+	rw = request(h, http.MethodPost, "/lobby/broadcast", `{"payload": 1}`)
+	is.Equal(rw.Code, http.StatusBadRequest)
+	rw = request(h, http.MethodGet, "/lobby/broadcast", "")
+	is.Equal(rw.Code, http.StatusMethodNotAllowed)
+
+	rw = request(h, http.MethodPost, "/lobby/kick", `{"user_id": "lobby1", "reason": "Spam"}`)
+	is.Equal(rw.Code, http.StatusNoContent)
+	is.NoErr(first.ExpectClose(sockparty.StatusPolicyViolation))
+	id, err := recorder.ExpectLeave()
+	is.NoErr(err)
+	is.Equal(id, "lobby1")
+	rw = request(h, http.MethodPost, "/lobby/kick", `{"user_id": "lobby1"}`)
+	is.Equal(rw.Code, http.StatusNotFound)
+
+	// Reasons must fit in a close frame.
+	long := strings.Repeat("a", sockparty.MaxCloseReason+1)
+	rw = request(h, http.MethodPost, "/lobby/kick", `{"user_id": "lobby2", "reason": "`+long+`"}`)
+	is.Equal(rw.Code, http.StatusBadRequest)
+	rw = request(h, http.MethodPost, "/lobby/end", `{"reason": "`+long+`"}`)
+	is.Equal(rw.Code, http.StatusBadRequest)
+	is.Equal(party.GetConnectedUserCount(), 1)
+
+	rw = request(h, http.MethodPost, "/lobby/end", `{"reason": "Bye"}`)
+	is.Equal(rw.Code, http.StatusNoContent)
+	is.NoErr(second.ExpectClose(sockparty.StatusNormalClosure))
+	is.Equal(party.GetConnectedUserCount(), 0)
+	id, err = recorder.ExpectLeave()
+	is.NoErr(err)
+	is.Equal(id, "lobby2")
+}
@@ -0,0 +1,132 @@
+package sockparty
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrInboxFull is returned when a user is disconnected for sending messages faster than they can be delivered.
+var ErrInboxFull = errors.New("User's inbox is full")
+
+const overloaded = "Too many messages."
+
+/*
+BackpressurePolicy determines what happens to a user's incoming messages when their inbox is full,
+because the consumer isn't receiving messages as fast as the user is sending them.
+*/
+type BackpressurePolicy int
+
+const (
+	// BackpressureBlock waits for room in the inbox, up to the BackpressureTimeout if set,
+	// after which the message is dropped.
+	BackpressureBlock BackpressurePolicy = iota
+	// BackpressureDrop drops the message, see DroppedMessages.
+	BackpressureDrop
+	// BackpressureDisconnect disconnects the user who sent the message.
+	BackpressureDisconnect
+)
+
+/*
+DroppedMessages returns the number of incoming messages dropped because a user's inbox was full.
+See the Backpressure option.
+*/
+func (party *Party) DroppedMessages() uint64 {
+	return atomic.LoadUint64(&party.dropped)
+}
+
+// inboxItem is an incoming message waiting in an inbox, either JSON or binary, and the party it was sent to.
+type inboxItem struct {
+	party   *Party
+	message *Incoming
+	binary  *IncomingBinary
+}
+
+/* Each user's incoming messages are queued in their own bounded inbox, and delivered
+to the consumer by their own pump routine. A user flooding messages only fills their
+own inbox, and everyone's pumps take turns delivering to the consumer. */
+
+// Queue an incoming message in the user's inbox, according to the backpressure policy.
+func (usr *User) enqueue(ctx context.Context, item inboxItem) error {
+	select {
+	case usr.inbox <- item:
+		return nil
+	default:
+	}
+
+	switch usr.opts.Backpressure {
+	case BackpressureDrop:
+		atomic.AddUint64(&item.party.dropped, 1)
+		return nil
+	case BackpressureDisconnect:
+		return ErrInboxFull
+	}
+
+	// Block, with an optional timeout.
+	var timeout <-chan time.Time
+	if usr.opts.BackpressureTimeout > 0 {
+		timer := usr.opts.clock().NewTimer(usr.opts.BackpressureTimeout)
+		defer timer.Stop()
+		timeout = timer.C()
+	}
+	select {
+	case usr.inbox <- item:
+		return nil
+	case <-timeout:
+		atomic.AddUint64(&item.party.dropped, 1)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Deliver messages from the user's inbox until the context is canceled, then mark the inbox drained.
+// Messages still in the inbox once the user is leaving are discarded.
+func (usr *User) pump(ctx context.Context) {
+	defer close(usr.drained)
+	// Fire any transfer still pending before the user leaves.
+	defer func() {
+		usr.follow(usr.currentParty())
+	}()
+	defer usr.leave()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-usr.moved:
+			usr.followTransfer()
+		case item := <-usr.inbox:
+			usr.follow(item.party)
+			if !usr.deliver(ctx, item) {
+				return
+			}
+			usr.followTransfer()
+		}
+	}
+}
+
+// Deliver an item from the inbox to the consumer, returning false if the context is canceled first.
+func (usr *User) deliver(ctx context.Context, item inboxItem) bool {
+	if item.binary != nil {
+		binary := *item.binary
+		if !item.party.subs.publishBinary(ctx, binary) {
+			return false
+		}
+		item.party.dispatch(usr, func(handler Handler) {
+			if handler, ok := handler.(BinaryHandler); ok {
+				handler.OnBinary(binary)
+			}
+		})
+		return true
+	}
+
+	message := *item.message
+	if !item.party.subs.publishIncoming(ctx, message) {
+		return false
+	}
+	item.party.dispatch(usr, func(handler Handler) {
+		handler.OnMessage(message)
+	})
+	return true
+}
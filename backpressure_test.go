@@ -0,0 +1,96 @@
+package sockparty_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/posener/wstest"
+
+	"github.com/izzymg/sockparty"
+)
+
+// Wait up to a second for the party to have dropped n messages.
+func waitDropped(party *sockparty.Party, n uint64) bool {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if party.DroppedMessages() >= n {
+			return true
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return false
+}
+
+// Test messages are dropped when a user's inbox is full, for the drop and block policies.
+func TestBackpressureDrop(t *testing.T) {
+	policies := map[string]*sockparty.Options{
+		"Drop": {
+			InboxSize:    1,
+			Backpressure: sockparty.BackpressureDrop,
+		},
+		"Block": {
+			InboxSize:           1,
+			Backpressure:        sockparty.BackpressureBlock,
+			BackpressureTimeout: time.Millisecond * 10,
+		},
+	}
+
+	for name, options := range policies {
+		options := options
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+
+			// Nothing receives from the incoming channel.
+			party := sockparty.New(generateUID, options)
+			party.RegisterIncoming(make(chan sockparty.Incoming))
+
+			d := wstest.NewDialer(party)
+			c, _, err := d.Dial(addr, nil)
+			is.NoErr(err)
+			defer c.Close()
+
+			// One message is stuck delivering, one is in the inbox, the rest are dropped.
+			for i := 0; i < 5; i++ {
+				is.NoErr(c.WriteJSON(&sockparty.Outgoing{Event: "flood"}))
+			}
+			is.True(waitDropped(party, 3))
+			is.Equal(party.GetConnectedUserCount(), 1)
+		})
+	}
+}
+
+// Test users are disconnected when their inbox is full, for the disconnect policy.
+func TestBackpressureDisconnect(t *testing.T) {
+	is := is.New(t)
+
+	party := sockparty.New(generateUID, &sockparty.Options{
+		InboxSize:    1,
+		Backpressure: sockparty.BackpressureDisconnect,
+	})
+	party.RegisterIncoming(make(chan sockparty.Incoming))
+	userLeft := make(chan string, 1)
+	party.RegisterOnUserLeft(userLeft)
+
+	d := wstest.NewDialer(party)
+	c, _, err := d.Dial(addr, nil)
+	is.NoErr(err)
+	defer c.Close()
+	go func() {
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		is.NoErr(c.WriteJSON(&sockparty.Outgoing{Event: "flood"}))
+	}
+	select {
+	case <-userLeft:
+	case <-time.After(time.Second * 10):
+		t.Fatal("User wasn't disconnected")
+	}
+	is.Equal(party.DroppedMessages(), uint64(0))
+}
@@ -0,0 +1,60 @@
+package sockparty
+
+import (
+	"context"
+)
+
+/*
+IncomingBinary represents a binary socket message from a user, destined to the server.
+Binary messages bypass the JSON event protocol, for raw data such as audio or images.
+The event is only set for chunked uploads, see Chunk.
+*/
+type IncomingBinary struct {
+	UserID string
+	Event  Event
+	Data   []byte
+}
+
+// BinaryHandler may be implemented by a Handler to also receive binary messages.
+type BinaryHandler interface {
+	OnBinary(message IncomingBinary)
+}
+
+/*
+RegisterIncomingBinary registers the channel to be used for all incoming binary messages,
+replacing the previous if any. If there's no channel registered or subscribed, binary
+messages are discarded. Like RegisterIncoming, the consumer must receive from it to
+avoid blocking the party.
+*/
+func (party *Party) RegisterIncomingBinary(ch chan IncomingBinary) {
+	party.subs.setBinary(registeredID, ch)
+}
+
+// SubscribeIncomingBinary adds a channel to receive all incoming binary messages, see SubscribeIncoming.
+func (party *Party) SubscribeIncomingBinary(ch chan IncomingBinary) Unsubscribe {
+	id := party.subs.newID()
+	party.subs.setBinary(id, ch)
+	return func() {
+		party.subs.setBinary(id, nil)
+	}
+}
+
+// SendBinary writes a binary message to a user by their ID.
+func (party *Party) SendBinary(ctx context.Context, userID string, data []byte) error {
+	party.mut.RLock()
+	defer party.mut.RUnlock()
+	if usr, ok := party.connectedUsers[userID]; ok {
+		return usr.writeBinary(ctx, data)
+	}
+	return ErrNoSuchUser
+}
+
+// BroadcastBinary writes a binary message to all users currently active in the party.
+func (party *Party) BroadcastBinary(ctx context.Context, data []byte) error {
+	party.mut.RLock()
+	defer party.mut.RUnlock()
+	for _, usr := range party.connectedUsers {
+		usr.writeBinary(ctx, data)
+	}
+	return nil
+}
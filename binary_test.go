@@ -0,0 +1,93 @@
+package sockparty_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/matryer/is"
+	"github.com/posener/wstest"
+
+	"github.com/izzymg/sockparty"
+)
+
+// Test binary messages pass through both ways, alongside JSON messages.
+func TestBinary(t *testing.T) {
+	is := is.New(t)
+
+	party := sockparty.New(generateUID, &sockparty.Options{
+		PingFrequency: 0,
+	})
+	userJoined := make(chan string)
+	incoming := make(chan sockparty.Incoming)
+	binary := make(chan sockparty.IncomingBinary)
+	party.RegisterOnUserJoined(userJoined)
+	party.RegisterIncoming(incoming)
+	party.RegisterIncomingBinary(binary)
+
+	d := wstest.NewDialer(party)
+	c, _, err := d.Dial(addr, nil)
+	is.NoErr(err)
+	defer c.Close()
+	id := <-userJoined
+
+	// Client to server
+	is.NoErr(c.WriteMessage(websocket.BinaryMessage, []byte{0xde, 0xad}))
+	received := <-binary
+	is.Equal(received.UserID, id)
+	is.Equal(received.Data, []byte{0xde, 0xad})
+
+	is.NoErr(c.WriteJSON(&sockparty.Outgoing{Event: "chat_message"}))
+	is.Equal((<-incoming).Event, sockparty.Event("chat_message"))
+
+	// Server to client
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	go func() {
+		party.SendBinary(ctx, id, []byte{0xbe, 0xef})
+		party.BroadcastBinary(ctx, []byte{0xca, 0xfe})
+	}()
+	typ, data, err := c.ReadMessage()
+	is.NoErr(err)
+	is.Equal(typ, websocket.BinaryMessage)
+	is.Equal(data, []byte{0xbe, 0xef})
+	typ, data, err = c.ReadMessage()
+	is.NoErr(err)
+	is.Equal(typ, websocket.BinaryMessage)
+	is.Equal(data, []byte{0xca, 0xfe})
+
+	is.Equal(party.SendBinary(ctx, "idontexist", nil), sockparty.ErrNoSuchUser)
+}
+
+type binaryHandler struct {
+	recordingHandler
+	binary chan sockparty.IncomingBinary
+}
+
+func (h *binaryHandler) OnBinary(message sockparty.IncomingBinary) {
+	h.binary <- message
+}
+
+// Test handlers implementing BinaryHandler receive binary messages.
+func TestBinaryHandler(t *testing.T) {
+	is := is.New(t)
+
+	party := sockparty.New(generateUID, &sockparty.Options{
+		PingFrequency: 0,
+		Dispatch:      sockparty.DispatchPerUser,
+	})
+	handler := &binaryHandler{
+		recordingHandler: recordingHandler{calls: make(chan string, 16)},
+		binary:           make(chan sockparty.IncomingBinary),
+	}
+	party.SetHandler(handler)
+
+	d := wstest.NewDialer(party)
+	c, _, err := d.Dial(addr, nil)
+	is.NoErr(err)
+	defer c.Close()
+
+	is.NoErr(c.WriteMessage(websocket.BinaryMessage, []byte("blob")))
+	is.Equal((<-handler.binary).Data, []byte("blob"))
+}
@@ -0,0 +1,171 @@
+package sockparty
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Errors reported when a user's chunked upload is discarded.
+var (
+	ErrUploadTooLarge = errors.New("Upload exceeds the maximum upload size")
+	ErrUploadSequence = errors.New("Upload chunk out of sequence")
+	ErrTooManyUploads = errors.New("Too many uploads in progress")
+)
+
+const (
+	defaultChunkSize = 16 * 1024
+	// Maximum uploads a single user may have in progress.
+	maxUploads = 8
+	// How long an upload may go without a chunk before it's abandoned, making room for new uploads.
+	uploadIdleTimeout = time.Minute
+)
+
+/*
+Chunk is the payload of an EventChunk message, one piece of a large payload transferred in order.
+Chunks with the same transfer ID are concatenated in sequence, starting from zero,
+until the final chunk. The event is that of the reassembled payload.
+Data is encoded as base64 in JSON. Uploads which go a minute without a chunk may be discarded.
+*/
+type Chunk struct {
+	TransferID string `json:"transfer_id"`
+	Event      Event  `json:"event"`
+	Seq        int    `json:"seq"`
+	Data       []byte `json:"data"`
+	Final      bool   `json:"final"`
+}
+
+// StreamProgress is called after each chunk of a stream is written, with the total bytes sent so far.
+type StreamProgress func(sent int64)
+
+/*
+Stream sends a large payload read from r to a user by their ID, split into ordered chunks
+under a new transfer ID. Chunks are sent at low priority, so other messages to the user
+are written between chunks, and the connection isn't blocked for the whole transfer.
+Blocks until the payload is sent, returning the transfer ID. The progress function is optional.
+*/
+func (party *Party) Stream(ctx context.Context, userID string, event Event, r io.Reader, progress StreamProgress) (string, error) {
+	usr, err := party.GetUser(userID)
+	if err != nil {
+		return "", err
+	}
+	transferID, err := newTransferID()
+	if err != nil {
+		return "", err
+	}
+
+	chunkSize := party.opts.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+	buf := make([]byte, chunkSize)
+	var sent int64
+	for seq := 0; ; seq++ {
+		n, err := io.ReadFull(r, buf)
+		final := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !final {
+			return transferID, fmt.Errorf("Read stream failed: %w", err)
+		}
+		err = usr.write(ctx, &Outgoing{
+			Event:    EventChunk,
+			Priority: PriorityLow,
+			Payload: &Chunk{
+				TransferID: transferID,
+				Event:      event,
+				Seq:        seq,
+				Data:       buf[:n],
+				Final:      final,
+			},
+		})
+		if err != nil {
+			return transferID, err
+		}
+		sent += int64(n)
+		if progress != nil {
+			progress(sent)
+		}
+		if final {
+			return transferID, nil
+		}
+	}
+}
+
+// upload is a chunked payload being received from a user.
+type upload struct {
+	event   Event
+	nextSeq int
+	data    bytes.Buffer
+	// When the last chunk was received
+	updated time.Time
+}
+
+/*
+Add a chunk from the user to its upload, returning the reassembled payload once complete.
+Uploads are only touched by the user's reading routine, so need no lock.
+*/
+func (usr *User) receiveChunk(message *Incoming) (*IncomingBinary, error) {
+	chunk := Chunk{}
+	err := json.Unmarshal(message.Payload, &chunk)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid chunk payload: %w", err)
+	}
+
+	now := usr.opts.clock().Now()
+	up, ok := usr.uploads[chunk.TransferID]
+	if !ok {
+		if len(usr.uploads) >= maxUploads {
+			usr.expireUploads(now)
+		}
+		if len(usr.uploads) >= maxUploads {
+			return nil, ErrTooManyUploads
+		}
+		up = &upload{event: chunk.Event}
+		usr.uploads[chunk.TransferID] = up
+	}
+	if chunk.Seq != up.nextSeq {
+		delete(usr.uploads, chunk.TransferID)
+		return nil, fmt.Errorf("%w: expected %d, got %d", ErrUploadSequence, up.nextSeq, chunk.Seq)
+	}
+	if int64(up.data.Len()+len(chunk.Data)) > usr.opts.MaxUploadSize {
+		delete(usr.uploads, chunk.TransferID)
+		return nil, ErrUploadTooLarge
+	}
+	up.nextSeq++
+	up.data.Write(chunk.Data)
+	up.updated = now
+
+	if !chunk.Final {
+		return nil, nil
+	}
+	delete(usr.uploads, chunk.TransferID)
+	return &IncomingBinary{
+		UserID: usr.ID,
+		Event:  up.event,
+		Data:   up.data.Bytes(),
+	}, nil
+}
+
+// Discard uploads abandoned by the user, which haven't had a chunk for the idle timeout.
+func (usr *User) expireUploads(now time.Time) {
+	for id, up := range usr.uploads {
+		if now.Sub(up.updated) > uploadIdleTimeout {
+			delete(usr.uploads, id)
+		}
+	}
+}
+
+// Generate a random ID for a transfer.
+func newTransferID() (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", fmt.Errorf("Generate transfer ID failed: %w", err)
+	}
+	return hex.EncodeToString(id), nil
+}
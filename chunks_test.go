@@ -0,0 +1,164 @@
+package sockparty_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/posener/wstest"
+
+	"github.com/izzymg/sockparty"
+	"github.com/izzymg/sockparty/sockpartytest"
+)
+
+// Test large payloads are streamed to users in ordered chunks.
+func TestStream(t *testing.T) {
+	is := is.New(t)
+
+	party := sockparty.New(generateUID, &sockparty.Options{
+		PingFrequency: 0,
+		ChunkSize:     16,
+	})
+	userJoined := make(chan string)
+	party.RegisterOnUserJoined(userJoined)
+
+	d := wstest.NewDialer(party)
+	c, _, err := d.Dial(addr, nil)
+	is.NoErr(err)
+	defer c.Close()
+	id := <-userJoined
+
+	payload := bytes.Repeat([]byte("subtitles!"), 4)
+	var progress []int64
+	type result struct {
+		transferID string
+		err        error
+	}
+	done := make(chan result)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		transferID, err := party.Stream(ctx, id, "subtitles", bytes.NewReader(payload), func(sent int64) {
+			progress = append(progress, sent)
+		})
+		done <- result{transferID, err}
+	}()
+
+	// Reassemble the chunks as a client would.
+	var reassembled []byte
+	var transferID string
+	for seq := 0; ; seq++ {
+		var message struct {
+			Event   sockparty.Event `json:"event"`
+			Payload sockparty.Chunk `json:"payload"`
+		}
+		is.NoErr(c.ReadJSON(&message))
+		is.Equal(message.Event, sockparty.EventChunk)
+		is.Equal(message.Payload.Event, sockparty.Event("subtitles"))
+		is.Equal(message.Payload.Seq, seq)
+		transferID = message.Payload.TransferID
+		reassembled = append(reassembled, message.Payload.Data...)
+		if message.Payload.Final {
+			break
+		}
+	}
+
+	res := <-done
+	is.NoErr(res.err)
+	is.Equal(res.transferID, transferID)
+	is.Equal(reassembled, payload)
+	is.Equal(progress, []int64{16, 32, 40})
+}
+
+// Test chunked uploads from users are reassembled and delivered as binary.
+func TestUpload(t *testing.T) {
+	is := is.New(t)
+
+	party := sockparty.New(generateUID, &sockparty.Options{
+		PingFrequency: 0,
+		MaxUploadSize: 32,
+	})
+	binary := make(chan sockparty.IncomingBinary)
+	party.RegisterIncomingBinary(binary)
+	errs := make(chan error, 1)
+	party.ErrorHandler = func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+
+	d := wstest.NewDialer(party)
+	c, _, err := d.Dial(addr, nil)
+	is.NoErr(err)
+	defer c.Close()
+
+	send := func(chunk sockparty.Chunk) {
+		payload, err := json.Marshal(&chunk)
+		is.NoErr(err)
+		is.NoErr(c.WriteJSON(&sockparty.Incoming{
+			Event:   sockparty.EventChunk,
+			Payload: payload,
+		}))
+	}
+
+	send(sockparty.Chunk{TransferID: "a", Event: "thumbnail", Seq: 0, Data: []byte("hello ")})
+	send(sockparty.Chunk{TransferID: "a", Event: "thumbnail", Seq: 1, Data: []byte("world"), Final: true})
+	upload := <-binary
+	is.Equal(upload.Event, sockparty.Event("thumbnail"))
+	is.Equal(upload.Data, []byte("hello world"))
+
+	// Out of order chunks discard the upload.
+	send(sockparty.Chunk{TransferID: "b", Event: "thumbnail", Seq: 1, Data: []byte("world")})
+	is.True(errors.Is(<-errs, sockparty.ErrUploadSequence))
+
+	// As do uploads over the maximum size.
+	send(sockparty.Chunk{TransferID: "c", Event: "thumbnail", Seq: 0, Data: bytes.Repeat([]byte("a"), 33)})
+	is.True(errors.Is(<-errs, sockparty.ErrUploadTooLarge))
+}
+
+// Test abandoned uploads expire, making room for new ones.
+func TestUploadExpiry(t *testing.T) {
+	is := is.New(t)
+
+	clock := sockpartytest.NewFakeClock(time.Unix(0, 0))
+	party := sockparty.New(generateUID, &sockparty.Options{
+		PingFrequency: 0,
+		MaxUploadSize: 32,
+		Clock:         clock,
+	})
+	binary := make(chan sockparty.IncomingBinary)
+	party.RegisterIncomingBinary(binary)
+	errs := make(chan error, 1)
+	party.ErrorHandler = func(err error) {
+		errs <- err
+	}
+
+	c, _, err := wstest.NewDialer(party).Dial(addr, nil)
+	is.NoErr(err)
+	defer c.Close()
+	send := func(chunk sockparty.Chunk) {
+		payload, err := json.Marshal(&chunk)
+		is.NoErr(err)
+		is.NoErr(c.WriteJSON(&sockparty.Incoming{
+			Event:   sockparty.EventChunk,
+			Payload: payload,
+		}))
+	}
+
+	for i := 0; i < 8; i++ {
+		send(sockparty.Chunk{TransferID: fmt.Sprint(i), Event: "thumbnail", Seq: 0, Data: []byte("a")})
+	}
+	send(sockparty.Chunk{TransferID: "new", Event: "thumbnail", Seq: 0, Data: []byte("a"), Final: true})
+	is.True(errors.Is(<-errs, sockparty.ErrTooManyUploads))
+
+	clock.Advance(time.Minute * 2)
+	send(sockparty.Chunk{TransferID: "new", Event: "thumbnail", Seq: 0, Data: []byte("a"), Final: true})
+	upload := <-binary
+	is.Equal(upload.Data, []byte("a"))
+}
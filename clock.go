@@ -0,0 +1,118 @@
+package sockparty
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+/*
+Clock tells the time and schedules timers for a party's pings, timeouts and rate limits.
+Replace it with a fake clock to test time dependent behavior without waiting,
+see the sockpartytest package.
+*/
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer sends the time on its channel once, after its duration, unless stopped.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// Ticker sends the time on its channel after every period, until stopped.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Clock returns the clock used by the party, see the Clock option.
+func (party *Party) Clock() Clock {
+	return party.opts.clock()
+}
+
+// Returns the clock to use, the real clock if none is set.
+func (opts *Options) clock() Clock {
+	if opts.Clock != nil {
+		return opts.Clock
+	}
+	return realClock{}
+}
+
+// realClock is backed by the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+/*
+Returns a copy of the context which is canceled after the duration on the clock,
+and a channel closed if it was canceled because the duration elapsed.
+*/
+func withClockTimeout(ctx context.Context, clock Clock, d time.Duration) (context.Context, <-chan struct{}, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	expired := make(chan struct{})
+	timer := clock.NewTimer(d)
+	go func() {
+		defer timer.Stop()
+		select {
+		case <-timer.C():
+			close(expired)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, expired, cancel
+}
+
+// Wait for the limiter to allow an event, according to the clock.
+func waitLimiter(ctx context.Context, clock Clock, limiter *rate.Limiter) error {
+	now := clock.Now()
+	reservation := limiter.ReserveN(now, 1)
+	if !reservation.OK() {
+		return errors.New("Rate limiter burst is zero")
+	}
+	delay := reservation.DelayFrom(now)
+	if delay <= 0 {
+		return nil
+	}
+	timer := clock.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		return nil
+	case <-ctx.Done():
+		reservation.CancelAt(clock.Now())
+		return ctx.Err()
+	}
+}
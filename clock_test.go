@@ -0,0 +1,85 @@
+package sockparty_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/posener/wstest"
+	"golang.org/x/time/rate"
+
+	"github.com/izzymg/sockparty"
+	"github.com/izzymg/sockparty/sockpartytest"
+)
+
+// Test users who don't answer pings are dropped once the ping times out on the party's clock.
+func TestPingTimeout(t *testing.T) {
+	is := is.New(t)
+
+	clock := sockpartytest.NewFakeClock(time.Now())
+	party := sockparty.New(generateUID, &sockparty.Options{
+		PingFrequency: time.Minute,
+		PingTimeout:   time.Minute,
+		Clock:         clock,
+	})
+	recorder := sockpartytest.Record(party)
+	defer recorder.Stop()
+
+	// This client never reads, so never answers pings.
+	d := wstest.NewDialer(party)
+	c, _, err := d.Dial(addr, nil)
+	is.NoErr(err)
+	defer c.Close()
+	id, err := recorder.ExpectJoin()
+	is.NoErr(err)
+
+	// Wait for the ping ticker, then the ping's timeout.
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	clock.BlockUntil(2)
+	clock.Advance(time.Minute)
+
+	left, err := recorder.ExpectLeave()
+	is.NoErr(err)
+	is.Equal(left, id)
+}
+
+// Test incoming messages are rate limited on the party's clock.
+func TestRateLimitClock(t *testing.T) {
+	is := is.New(t)
+
+	clock := sockpartytest.NewFakeClock(time.Now())
+	party := sockparty.New(generateUID, &sockparty.Options{
+		PingFrequency: 0,
+		RateLimiter:   rate.NewLimiter(rate.Every(time.Second), 1),
+		Clock:         clock,
+	})
+	recorder := sockpartytest.Record(party)
+	defer recorder.Stop()
+
+	c, err := sockpartytest.Dial(party)
+	is.NoErr(err)
+	defer c.Close()
+
+	is.NoErr(c.Send("chat_message", "first"))
+	_, err = recorder.ExpectIncoming()
+	is.NoErr(err)
+	// Writes block until the party reads them.
+	sent := make(chan error, 1)
+	go func() {
+		sent <- c.Send("chat_message", "second")
+	}()
+
+	// The second message waits for the limiter.
+	clock.BlockUntil(1)
+	recorder.Timeout = time.Millisecond * 50
+	_, err = recorder.ExpectIncoming()
+	is.True(errors.Is(err, sockpartytest.ErrTimeout))
+
+	clock.Advance(time.Second)
+	recorder.Timeout = sockpartytest.DefaultTimeout
+	_, err = recorder.ExpectIncoming()
+	is.NoErr(err)
+	is.NoErr(<-sent)
+}
@@ -0,0 +1,338 @@
+/*
+Command sockparty-bench load tests a running party. It opens many concurrent client
+connections, sends a mix of events at a target rate, and reports join latency,
+broadcast fan-out latency, dropped connections and memory use.
+
+Fan-out latency is measured from the server time stamped on received messages, see
+Outgoing.Stamp, so the party must stamp its broadcasts, and run on a host with a clock
+synced to this one. With -local, a party which broadcasts every incoming message
+is run in this process, and memory use includes the party.
+
+	sockparty-bench -url ws://localhost:3000 -clients 1000 -rate 500 -duration 1m
+	sockparty-bench -local -clients 1000 -events chat_message:3,typing:1
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"nhooyr.io/websocket"
+
+	"github.com/izzymg/sockparty"
+)
+
+// config holds the command's flags.
+type config struct {
+	url         string
+	local       bool
+	clients     int
+	dialers     int
+	rate        float64
+	duration    time.Duration
+	events      []sockparty.Event
+	payloadSize int
+}
+
+// results are counted by all clients during a run.
+type results struct {
+	joined   int64
+	failed   int64
+	dropped  int64
+	sent     int64
+	received int64
+	join     *samples
+	fanout   *samples
+	// Measured while every client is connected.
+	mem        runtime.MemStats
+	goroutines int
+}
+
+func main() {
+	cfg, err := parseFlags()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if cfg.local {
+		url, stop, err := serveLocal()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer stop()
+		cfg.url = url
+	}
+
+	res := run(cfg)
+	report(cfg, res)
+}
+
+func parseFlags() (*config, error) {
+	cfg := &config{}
+	var events string
+	flag.StringVar(&cfg.url, "url", "ws://localhost:3000", "WebSocket URL of the party")
+	flag.BoolVar(&cfg.local, "local", false, "Run a party which broadcasts every incoming message in this process, instead of using -url")
+	flag.IntVar(&cfg.clients, "clients", 100, "Number of concurrent clients")
+	flag.IntVar(&cfg.dialers, "dialers", 50, "Number of clients connecting at once")
+	flag.Float64Var(&cfg.rate, "rate", 100, "Messages per second sent by all clients together")
+	flag.DurationVar(&cfg.duration, "duration", time.Second*30, "How long to send messages for, after all clients join")
+	flag.StringVar(&events, "events", "chat_message", "Events to send separated by commas, each with an optional :weight")
+	flag.IntVar(&cfg.payloadSize, "payload", 64, "Size in bytes of each message's payload")
+	flag.Parse()
+
+	if cfg.clients < 1 || cfg.dialers < 1 {
+		return nil, errors.New("Clients and dialers must be at least 1")
+	}
+	if cfg.rate <= 0 {
+		return nil, errors.New("Rate must be above 0")
+	}
+	mix, err := parseEvents(events)
+	if err != nil {
+		return nil, err
+	}
+	cfg.events = mix
+	return cfg, nil
+}
+
+/*
+Parse an event mix such as "chat_message:3,typing:1" into a list with each event
+repeated by its weight, so picking randomly from it follows the weights.
+Weights are optional, so namespaced events such as "sockparty:timesync" are kept whole.
+*/
+func parseEvents(s string) ([]sockparty.Event, error) {
+	var mix []sockparty.Event
+	for _, pair := range strings.Split(s, ",") {
+		event, weight := pair, 1
+		if i := strings.LastIndex(pair, ":"); i >= 0 {
+			if w, err := strconv.Atoi(pair[i+1:]); err == nil {
+				if w < 0 {
+					return nil, fmt.Errorf("Invalid weight in event %q", pair)
+				}
+				event, weight = pair[:i], w
+			}
+		}
+		if event == "" {
+			return nil, fmt.Errorf("Empty event in %q", s)
+		}
+		for i := 0; i < weight; i++ {
+			mix = append(mix, sockparty.Event(event))
+		}
+	}
+	if len(mix) == 0 {
+		return nil, errors.New("No events to send")
+	}
+	return mix, nil
+}
+
+// Serve a party which broadcasts every incoming message back to everyone, stamped.
+func serveLocal() (string, func(), error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, fmt.Errorf("Listen failed: %w", err)
+	}
+
+	var ids int64
+	opts := sockparty.DefaultOptions()
+	opts.RateLimiter = nil
+	party := sockparty.New(func() (string, error) {
+		return strconv.FormatInt(atomic.AddInt64(&ids, 1), 10), nil
+	}, opts)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	incoming := make(chan sockparty.Incoming, 256)
+	party.RegisterIncoming(incoming)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case message := <-incoming:
+				party.Broadcast(ctx, (&sockparty.Outgoing{
+					Event:   message.Event,
+					Payload: message.Payload,
+				}).Stamp())
+			}
+		}
+	}()
+
+	server := &http.Server{Handler: party}
+	go server.Serve(listener)
+	return "ws://" + listener.Addr().String(), func() {
+		cancel()
+		party.End("Benchmark over")
+		server.Close()
+	}, nil
+}
+
+// Connect every client, send messages for the duration, then disconnect everyone.
+func run(cfg *config) *results {
+	res := &results{
+		join:   newSamples(),
+		fanout: newSamples(),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Connect clients, a few at a time.
+	fmt.Fprintf(os.Stderr, "Connecting %d clients to %s\n", cfg.clients, cfg.url)
+	var conns []*websocket.Conn
+	var connsMut sync.Mutex
+	var wg sync.WaitGroup
+	dialing := make(chan struct{}, cfg.dialers)
+	for i := 0; i < cfg.clients; i++ {
+		dialing <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-dialing }()
+			conn, err := dial(ctx, cfg.url, res)
+			if err != nil {
+				atomic.AddInt64(&res.failed, 1)
+				return
+			}
+			connsMut.Lock()
+			conns = append(conns, conn)
+			connsMut.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	// Read from every client, and share the sending between them.
+	sends := make(chan sockparty.Event)
+	var closing int32
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn *websocket.Conn) {
+			defer wg.Done()
+			err := receive(ctx, conn, res)
+			if atomic.LoadInt32(&closing) == 0 {
+				fmt.Fprintf(os.Stderr, "Client dropped: %v\n", err)
+				atomic.AddInt64(&res.dropped, 1)
+			}
+		}(conn)
+		go send(ctx, conn, sends, cfg.payloadSize, res)
+	}
+
+	fmt.Fprintf(os.Stderr, "Sending %v messages per second for %v\n", cfg.rate, cfg.duration)
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / cfg.rate))
+	done := time.After(cfg.duration)
+sending:
+	for {
+		select {
+		case <-done:
+			break sending
+		case <-ticker.C:
+			select {
+			case sends <- cfg.events[rand.Intn(len(cfg.events))]:
+			default:
+				// Every client is still busy sending, skip this tick.
+			}
+		}
+	}
+	ticker.Stop()
+	runtime.ReadMemStats(&res.mem)
+	res.goroutines = runtime.NumGoroutine()
+
+	atomic.StoreInt32(&closing, 1)
+	for _, conn := range conns {
+		conn.Close(websocket.StatusNormalClosure, "Benchmark over")
+	}
+	cancel()
+	wg.Wait()
+	return res
+}
+
+// Connect a client, recording how long it took.
+func dial(ctx context.Context, url string, res *results) (*websocket.Conn, error) {
+	start := time.Now()
+	conn, _, err := websocket.Dial(ctx, url, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Client failed to join: %v\n", err)
+		return nil, err
+	}
+	res.join.add(time.Since(start))
+	atomic.AddInt64(&res.joined, 1)
+	conn.SetReadLimit(1 << 20)
+	return conn, nil
+}
+
+// Send messages from the channel until the context is canceled.
+func send(ctx context.Context, conn *websocket.Conn, sends <-chan sockparty.Event, payloadSize int, res *results) {
+	payload := strings.Repeat("a", payloadSize)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-sends:
+			data, err := json.Marshal(&sockparty.Outgoing{
+				Event:   event,
+				Payload: payload,
+			})
+			if err != nil {
+				return
+			}
+			if conn.Write(ctx, websocket.MessageText, data) != nil {
+				return
+			}
+			atomic.AddInt64(&res.sent, 1)
+		}
+	}
+}
+
+// Read messages until the connection closes, recording fan-out latency of stamped messages.
+func receive(ctx context.Context, conn *websocket.Conn, res *results) error {
+	for {
+		typ, data, err := conn.Read(ctx)
+		if err != nil {
+			return err
+		}
+		received := sockparty.UnixMillis(time.Now())
+		atomic.AddInt64(&res.received, 1)
+		if typ != websocket.MessageText {
+			continue
+		}
+		var message struct {
+			ServerTime float64 `json:"server_time"`
+		}
+		if json.Unmarshal(data, &message) != nil || message.ServerTime == 0 {
+			continue
+		}
+		res.fanout.add(time.Duration((received - message.ServerTime) * float64(time.Millisecond)))
+	}
+}
+
+// Print the results.
+func report(cfg *config, res *results) {
+	seconds := cfg.duration.Seconds()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "clients\t%d joined\t%d failed to join\t%d dropped\n", res.joined, res.failed, res.dropped)
+	fmt.Fprintf(w, "join latency\t%v\n", res.join)
+	fmt.Fprintf(w, "sent\t%d messages\t%.1f/s\n", res.sent, float64(res.sent)/seconds)
+	fmt.Fprintf(w, "received\t%d messages\t%.1f/s\n", res.received, float64(res.received)/seconds)
+	fmt.Fprintf(w, "fan-out latency\t%v\n", res.fanout)
+	fmt.Fprintf(w, "memory\t%.1f MiB heap\t%.1f MiB from OS\t%d goroutines\n",
+		mebibytes(res.mem.HeapInuse), mebibytes(res.mem.Sys), res.goroutines)
+	w.Flush()
+}
+
+func mebibytes(b uint64) float64 {
+	return float64(b) / (1024 * 1024)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/matryer/is"
+
+	"github.com/izzymg/sockparty"
+)
+
+// Test event mixes are weighted.
+func TestParseEvents(t *testing.T) {
+	is := is.New(t)
+
+	mix, err := parseEvents("chat_message:2,typing,sockparty:timesync:1")
+	is.NoErr(err)
+	is.Equal(mix, []sockparty.Event{"chat_message", "chat_message", "typing", "sockparty:timesync"})
+
+	// Suffixes which aren't weights are part of the event.
+	mix, err = parseEvents("sockparty:timesync,media:play:2")
+	is.NoErr(err)
+	is.Equal(mix, []sockparty.Event{"sockparty:timesync", "media:play", "media:play"})
+
+	_, err = parseEvents("chat_message:-1")
+	is.True(err != nil)
+	_, err = parseEvents("chat_message:0")
+	is.True(err != nil)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Maximum samples kept to calculate percentiles from, so long runs use bounded memory.
+const maxSamples = 100000
+
+/*
+samples collects durations and reports their percentiles. Once full, a random sample
+of everything added is kept, which keeps the percentiles representative.
+*/
+type samples struct {
+	mut       sync.Mutex
+	durations []time.Duration
+	count     int
+	max       time.Duration
+	rand      *rand.Rand
+}
+
+func newSamples() *samples {
+	return &samples{
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (s *samples) add(d time.Duration) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.count++
+	if d > s.max {
+		s.max = d
+	}
+	if len(s.durations) < maxSamples {
+		s.durations = append(s.durations, d)
+		return
+	}
+	// Replace a random sample, with decreasing probability.
+	if i := s.rand.Intn(s.count); i < maxSamples {
+		s.durations[i] = d
+	}
+}
+
+// Format the percentiles of the samples.
+func (s *samples) String() string {
+	s.mut.Lock()
+	sorted := make([]time.Duration, len(s.durations))
+	copy(sorted, s.durations)
+	count, max := s.count, s.max
+	s.mut.Unlock()
+
+	if count == 0 {
+		return "no samples"
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	percentile := func(p float64) time.Duration {
+		return sorted[int(p*float64(len(sorted)-1))]
+	}
+	return fmt.Sprintf("p50 %v\tp90 %v\tp99 %v\tmax %v\t(%d samples)",
+		round(percentile(0.5)), round(percentile(0.9)), round(percentile(0.99)), round(max), count)
+}
+
+// Round durations to be readable.
+func round(d time.Duration) time.Duration {
+	if d > time.Second {
+		return d.Round(time.Millisecond)
+	}
+	return d.Round(time.Microsecond)
+}
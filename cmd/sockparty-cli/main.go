@@ -0,0 +1,221 @@
+/*
+Command sockparty-cli is an interactive client for debugging parties. It prints every
+message received with its timestamps and pretty-printed payload, and sends each line typed.
+
+Lines are either a full message, as in example/message.json, or an event followed by
+an optional JSON payload. Payloads which aren't valid JSON are sent as strings.
+
+	{ "event": "chat_message", "payload": { "body": "My message to the chat" } }
+	chat_message { "body": "My message to the chat" }
+	chat_message My message to the chat
+	sockparty:state
+
+Close the connection with Ctrl-D.
+
+	sockparty-cli -url ws://localhost:3000 -origin http://localhost:3000 -header "Cookie: session=abc"
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"nhooyr.io/websocket"
+
+	"github.com/izzymg/sockparty"
+)
+
+// headerFlags collects repeated "Key: Value" header flags.
+type headerFlags http.Header
+
+func (h headerFlags) String() string {
+	return fmt.Sprint(http.Header(h))
+}
+
+func (h headerFlags) Set(value string) error {
+	i := strings.Index(value, ":")
+	if i < 1 {
+		return fmt.Errorf("Header %q should be formatted as \"Key: Value\"", value)
+	}
+	http.Header(h).Add(strings.TrimSpace(value[:i]), strings.TrimSpace(value[i+1:]))
+	return nil
+}
+
+func main() {
+	header := headerFlags{}
+	url := flag.String("url", "ws://localhost:3000", "WebSocket URL of the party")
+	subprotocols := flag.String("subprotocol", "", "Subprotocols to request, separated by commas")
+	origin := flag.String("origin", "", "Origin header to send")
+	compact := flag.Bool("compact", false, "Print payloads on one line")
+	flag.Var(header, "header", "Header to send, as \"Key: Value\", may be repeated")
+	flag.Parse()
+
+	if *origin != "" {
+		http.Header(header).Set("Origin", *origin)
+	}
+	options := &websocket.DialOptions{
+		HTTPHeader: http.Header(header),
+	}
+	if *subprotocols != "" {
+		options.Subprotocols = strings.Split(*subprotocols, ",")
+	}
+
+	err := run(context.Background(), *url, options, os.Stdin, os.Stdout, *compact)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// Connect to the party, printing received messages to out and sending lines from in, until either closes.
+func run(ctx context.Context, url string, options *websocket.DialOptions, in io.Reader, out io.Writer, compact bool) error {
+	conn, _, err := websocket.Dial(ctx, url, options)
+	if err != nil {
+		return fmt.Errorf("Connect failed: %w", err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	conn.SetReadLimit(1 << 24)
+	if subprotocol := conn.Subprotocol(); subprotocol != "" {
+		fmt.Fprintf(out, "Connected to %s with subprotocol %q\n", url, subprotocol)
+	} else {
+		fmt.Fprintf(out, "Connected to %s\n", url)
+	}
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- receive(ctx, conn, out, compact)
+	}()
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(in)
+		scanner.Buffer(nil, 1<<24)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	for {
+		select {
+		case err := <-closed:
+			if websocket.CloseStatus(err) != -1 {
+				fmt.Fprintf(out, "Closed by party: %v\n", err)
+				return nil
+			}
+			return err
+		case line, ok := <-lines:
+			if !ok {
+				return conn.Close(websocket.StatusNormalClosure, "")
+			}
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			data, err := parseLine(line)
+			if err != nil {
+				fmt.Fprintln(out, err)
+				continue
+			}
+			err = conn.Write(ctx, websocket.MessageText, data)
+			if err != nil {
+				return fmt.Errorf("Send failed: %w", err)
+			}
+		}
+	}
+}
+
+// Read and print messages until the connection closes.
+func receive(ctx context.Context, conn *websocket.Conn, out io.Writer, compact bool) error {
+	for {
+		typ, data, err := conn.Read(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(out, format(time.Now(), typ, data, compact))
+	}
+}
+
+// Parse a typed line into a message to send.
+func parseLine(line string) ([]byte, error) {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "{") {
+		message := sockparty.Incoming{}
+		err := json.Unmarshal([]byte(line), &message)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid message: %w", err)
+		}
+		if message.Event == "" {
+			return nil, errors.New("Message has no event")
+		}
+		return json.Marshal(&message)
+	}
+
+	event, payload := line, ""
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		event, payload = line[:i], strings.TrimSpace(line[i+1:])
+	}
+	message := sockparty.Outgoing{Event: sockparty.Event(event)}
+	if payload != "" {
+		if json.Valid([]byte(payload)) {
+			message.Payload = json.RawMessage(payload)
+		} else {
+			message.Payload = payload
+		}
+	}
+	return json.Marshal(&message)
+}
+
+// Format a received message for printing, with the time received, and the time sent if stamped.
+func format(received time.Time, typ websocket.MessageType, data []byte, compact bool) string {
+	const layout = "15:04:05.000"
+	if typ == websocket.MessageBinary {
+		return fmt.Sprintf("%s binary (%d bytes)\n%s", received.Format(layout), len(data), hexDump(data))
+	}
+
+	var message struct {
+		Event      sockparty.Event `json:"event"`
+		Payload    json.RawMessage `json:"payload"`
+		ServerTime float64         `json:"server_time"`
+	}
+	err := json.Unmarshal(data, &message)
+	if err != nil {
+		return fmt.Sprintf("%s invalid JSON: %s\n", received.Format(layout), data)
+	}
+
+	heading := fmt.Sprintf("%s %s", received.Format(layout), message.Event)
+	if message.ServerTime > 0 {
+		sent := time.Unix(0, int64(math.Round(message.ServerTime*float64(time.Millisecond))))
+		heading += fmt.Sprintf(" (sent %s)", sent.Format(layout))
+	}
+	if len(message.Payload) == 0 || string(message.Payload) == "null" {
+		return heading + "\n"
+	}
+
+	payload := &bytes.Buffer{}
+	if compact {
+		json.Compact(payload, message.Payload)
+		return fmt.Sprintf("%s %s\n", heading, payload)
+	}
+	json.Indent(payload, message.Payload, "  ", "  ")
+	return fmt.Sprintf("%s\n  %s\n", heading, payload)
+}
+
+// Format the start of binary data as hex.
+func hexDump(data []byte) string {
+	const max = 64
+	if len(data) > max {
+		return fmt.Sprintf("  % x ...\n", data[:max])
+	}
+	return fmt.Sprintf("  % x\n", data)
+}
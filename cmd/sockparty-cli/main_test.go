@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"nhooyr.io/websocket"
+)
+
+// Test typed lines are parsed into messages.
+func TestParseLine(t *testing.T) {
+	is := is.New(t)
+
+	tests := map[string]string{
+		`{ "event": "chat_message", "payload": { "body": "hi" } }`: `{"event":"chat_message","payload":{"body":"hi"}}`,
+		`chat_message { "body": "hi" }`:                            `{"event":"chat_message","payload":{"body":"hi"}}`,
+		`chat_message hello there`:                                 `{"event":"chat_message","payload":"hello there"}`,
+		`sockparty:state`:                                          `{"event":"sockparty:state","payload":null}`,
+	}
+	for line, expected := range tests {
+		data, err := parseLine(line)
+		is.NoErr(err)
+		is.Equal(string(data), expected)
+	}
+
+	_, err := parseLine(`{ "payload": 1 }`)
+	is.True(err != nil)
+	_, err = parseLine(`{ "event": `)
+	is.True(err != nil)
+}
+
+// Test received messages are printed with their times and payloads.
+func TestFormat(t *testing.T) {
+	is := is.New(t)
+
+	received := time.Date(2020, 1, 1, 12, 30, 15, int(time.Millisecond*250), time.Local)
+	sent := float64(received.Add(-time.Millisecond*100).UnixNano()) / float64(time.Millisecond)
+	data := []byte(`{"event":"chat_message","payload":{"body":"hi"},"server_time":` + formatFloat(sent) + `}`)
+
+	is.Equal(format(received, websocket.MessageText, data, false),
+		"12:30:15.250 chat_message (sent 12:30:15.150)\n  {\n    \"body\": \"hi\"\n  }\n")
+	is.Equal(format(received, websocket.MessageText, []byte(`{"event":"user_left","payload":"1"}`), true),
+		"12:30:15.250 user_left \"1\"\n")
+	is.Equal(format(received, websocket.MessageBinary, []byte{0xca, 0xfe}, false),
+		"12:30:15.250 binary (2 bytes)\n  ca fe\n")
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,103 @@
+package sockparty
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"nhooyr.io/websocket"
+)
+
+// CompressionMode determines whether messages are compressed with the permessage-deflate extension.
+type CompressionMode int
+
+const (
+	// CompressionDisabled sends all messages uncompressed.
+	CompressionDisabled CompressionMode = iota
+	// CompressionContextTakeover compresses with a sliding window kept between messages,
+	// which compresses repetitive messages best, at a memory cost per user.
+	CompressionContextTakeover
+	// CompressionNoContextTakeover compresses each message independently.
+	CompressionNoContextTakeover
+)
+
+// Convert to the websocket library's compression mode.
+func (mode CompressionMode) websocket() websocket.CompressionMode {
+	switch mode {
+	case CompressionContextTakeover:
+		return websocket.CompressionContextTakeover
+	case CompressionNoContextTakeover:
+		return websocket.CompressionNoContextTakeover
+	default:
+		return websocket.CompressionDisabled
+	}
+}
+
+// Compression holds counts of the bytes sent to a user, before and after compression.
+type Compression struct {
+	// Bytes of messages written to the user.
+	MessageBytes uint64
+	// Bytes written to the connection, after compression and framing.
+	WireBytes uint64
+}
+
+// Ratio returns the size of the data sent over the wire relative to the messages, lower is better.
+func (c Compression) Ratio() float64 {
+	if c.MessageBytes == 0 {
+		return 0
+	}
+	return float64(c.WireBytes) / float64(c.MessageBytes)
+}
+
+// Compression returns counts of the bytes sent to the user, to measure compression.
+func (usr *User) Compression() Compression {
+	compression := Compression{
+		MessageBytes: atomic.LoadUint64(&usr.messageBytes),
+	}
+	// Only known for WebSocket connections accepted by the party.
+	if counter, ok := usr.connection.(interface{ wireBytes() uint64 }); ok {
+		compression.WireBytes = counter.wireBytes()
+	}
+	return compression
+}
+
+/* Connections are counted by wrapping the response writer, so the connection hijacked
+during the upgrade is wrapped too. */
+
+// countingWriter wraps a response writer to count the bytes written to its hijacked connection.
+type countingWriter struct {
+	http.ResponseWriter
+	written uint64
+}
+
+func (cw *countingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := cw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("http.ResponseWriter does not implement http.Hijacker")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	// Anything still buffered belongs to the HTTP response, not the socket.
+	err = brw.Writer.Flush()
+	if err != nil {
+		return nil, nil, err
+	}
+	counted := &countingConn{Conn: conn, written: &cw.written}
+	return counted, bufio.NewReadWriter(brw.Reader, bufio.NewWriter(counted)), nil
+}
+
+// countingConn counts the bytes written to a connection.
+type countingConn struct {
+	net.Conn
+	written *uint64
+}
+
+func (cc *countingConn) Write(p []byte) (int, error) {
+	n, err := cc.Conn.Write(p)
+	atomic.AddUint64(cc.written, uint64(n))
+	return n, err
+}
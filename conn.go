@@ -0,0 +1,163 @@
+package sockparty
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"nhooyr.io/websocket"
+)
+
+// MessageType is the type of a message on a connection.
+type MessageType int
+
+const (
+	// MessageText messages hold JSON.
+	MessageText MessageType = iota + 1
+	// MessageBinary messages hold any data.
+	MessageBinary
+)
+
+// StatusCode is the status a connection is closed with, as defined for WebSocket by RFC 6455.
+type StatusCode int
+
+// Status codes used by parties.
+const (
+	StatusNormalClosure   StatusCode = 1000
+	StatusGoingAway       StatusCode = 1001
+	StatusPolicyViolation StatusCode = 1008
+	StatusInternalError   StatusCode = 1011
+)
+
+// MaxCloseReason is the longest reason a connection can be closed with, in bytes.
+const MaxCloseReason = 123
+
+// ErrReasonTooLong is returned when closing a connection with a reason over MaxCloseReason.
+var ErrReasonTooLong = fmt.Errorf("Close reason is longer than %d bytes", MaxCloseReason)
+
+// CloseError is returned when reading from a connection closed with a status.
+type CloseError struct {
+	Code   StatusCode
+	Reason string
+}
+
+func (e CloseError) Error() string {
+	return fmt.Sprintf("Connection closed with status %d: %q", e.Code, e.Reason)
+}
+
+/*
+Conn is a user's connection, over any transport. Only one routine reads and one writes
+at a time, but Ping and Close may be called concurrently with either.
+*/
+type Conn interface {
+	// Block until a message is received, returning a CloseError once closed with a status.
+	ReadMessage(ctx context.Context) (MessageType, []byte, error)
+	WriteMessage(ctx context.Context, typ MessageType, data []byte) error
+	// Block until the client responds, or the context is canceled.
+	Ping(ctx context.Context) error
+	Close(code StatusCode, reason string) error
+	// Subprotocol negotiated with the client, empty if none.
+	Subprotocol() string
+}
+
+/*
+Transport accepts connections from requests to join a party, see the Transport option.
+Wrap transports to wrap their connections, e.g. for instrumentation.
+*/
+type Transport interface {
+	// Accept the request, writing a response if an error is returned.
+	Accept(rw http.ResponseWriter, req *http.Request) (Conn, error)
+}
+
+// Returns the transport to use, WebSocket with the options' settings if none is set.
+func (opts *Options) transport() Transport {
+	if opts.Transport != nil {
+		return opts.Transport
+	}
+	return NewWebSocketTransport(opts)
+}
+
+/*
+NewWebSocketTransport creates the default transport, which upgrades requests to WebSocket
+configured by the options. Use it to wrap the default transport.
+*/
+func NewWebSocketTransport(options *Options) Transport {
+	return &webSocketTransport{opts: options}
+}
+
+type webSocketTransport struct {
+	opts *Options
+}
+
+func (t *webSocketTransport) Accept(rw http.ResponseWriter, req *http.Request) (Conn, error) {
+	// Count what's written for compression stats.
+	wire := &countingWriter{ResponseWriter: rw}
+	conn, err := websocket.Accept(wire, req, &websocket.AcceptOptions{
+		Subprotocols:         t.opts.Subprotocols,
+		InsecureSkipVerify:   true,
+		CompressionMode:      t.opts.Compression.websocket(),
+		CompressionThreshold: t.opts.CompressionThreshold,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if t.opts.ReadLimit > 0 {
+		conn.SetReadLimit(t.opts.ReadLimit)
+	}
+	return &webSocketConn{conn: conn, wire: wire}, nil
+}
+
+// WebSocketConn wraps an accepted WebSocket connection as a Conn.
+func WebSocketConn(conn *websocket.Conn) Conn {
+	return &webSocketConn{conn: conn}
+}
+
+type webSocketConn struct {
+	conn *websocket.Conn
+	// Optional, counts bytes written for compression stats.
+	wire *countingWriter
+}
+
+func (c *webSocketConn) ReadMessage(ctx context.Context) (MessageType, []byte, error) {
+	typ, data, err := c.conn.Read(ctx)
+	if err != nil {
+		var closeErr websocket.CloseError
+		if errors.As(err, &closeErr) {
+			return 0, nil, CloseError{Code: StatusCode(closeErr.Code), Reason: closeErr.Reason}
+		}
+		return 0, nil, err
+	}
+	if typ == websocket.MessageBinary {
+		return MessageBinary, data, nil
+	}
+	return MessageText, data, nil
+}
+
+func (c *webSocketConn) WriteMessage(ctx context.Context, typ MessageType, data []byte) error {
+	if typ == MessageBinary {
+		return c.conn.Write(ctx, websocket.MessageBinary, data)
+	}
+	return c.conn.Write(ctx, websocket.MessageText, data)
+}
+
+func (c *webSocketConn) Ping(ctx context.Context) error {
+	return c.conn.Ping(ctx)
+}
+
+func (c *webSocketConn) Close(code StatusCode, reason string) error {
+	return c.conn.Close(websocket.StatusCode(code), reason)
+}
+
+func (c *webSocketConn) Subprotocol() string {
+	return c.conn.Subprotocol()
+}
+
+// Bytes written to the connection, after compression and framing.
+func (c *webSocketConn) wireBytes() uint64 {
+	if c.wire == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&c.wire.written)
+}
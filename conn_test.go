@@ -0,0 +1,65 @@
+package sockparty_test
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/matryer/is"
+
+	"github.com/izzymg/sockparty"
+	"github.com/izzymg/sockparty/sockpartytest"
+)
+
+// countingTransport wraps a transport to count the messages read from its connections.
+type countingTransport struct {
+	sockparty.Transport
+	read int64
+}
+
+func (t *countingTransport) Accept(rw http.ResponseWriter, req *http.Request) (sockparty.Conn, error) {
+	conn, err := t.Transport.Accept(rw, req)
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: conn, read: &t.read}, nil
+}
+
+type countingConn struct {
+	sockparty.Conn
+	read *int64
+}
+
+func (c *countingConn) ReadMessage(ctx context.Context) (sockparty.MessageType, []byte, error) {
+	typ, data, err := c.Conn.ReadMessage(ctx)
+	if err == nil {
+		atomic.AddInt64(c.read, 1)
+	}
+	return typ, data, err
+}
+
+// Test transports can be wrapped to instrument their connections.
+func TestTransport(t *testing.T) {
+	is := is.New(t)
+
+	options := &sockparty.Options{
+		PingFrequency: 0,
+	}
+	transport := &countingTransport{Transport: sockparty.NewWebSocketTransport(options)}
+	options.Transport = transport
+	party := sockparty.New(generateUID, options)
+	recorder := sockpartytest.Record(party)
+	defer recorder.Stop()
+
+	c, err := sockpartytest.Dial(party)
+	is.NoErr(err)
+	defer c.Close()
+	is.NoErr(c.Send("chat_message", "hi"))
+	is.NoErr(c.SendBinary([]byte("blob")))
+	_, err = recorder.ExpectIncoming()
+	is.NoErr(err)
+	_, err = recorder.ExpectBinary()
+	is.NoErr(err)
+	is.Equal(atomic.LoadInt64(&transport.read), int64(2))
+}
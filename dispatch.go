@@ -0,0 +1,157 @@
+package sockparty
+
+import (
+	"hash/fnv"
+	"runtime"
+	"sync"
+)
+
+/*
+Handler receives a party's events, as an alternative to registering channels.
+Calls for a single user are always made in order: join, their messages, then leave.
+*/
+type Handler interface {
+	// Called when a user has joined the party, and is valid to message.
+	OnJoin(userID string)
+	// Called when a user has left the party, and is no longer valid to message.
+	OnLeave(userID string)
+	// Called with each incoming user message.
+	OnMessage(message Incoming)
+	// Called when an error occurs within the party.
+	OnError(err error)
+}
+
+// DispatchMode determines how a party calls its Handler.
+type DispatchMode int
+
+const (
+	// DispatchInline calls the handler directly from the user's own routines,
+	// so a slow handler only holds up the user it is handling.
+	DispatchInline DispatchMode = iota
+	// DispatchPerUser calls the handler from a dedicated routine per user.
+	DispatchPerUser
+	// DispatchPool calls the handler from a fixed pool of worker routines.
+	// Each user is always handled by the same worker.
+	DispatchPool
+)
+
+func newDispatcher(opts *Options) *dispatcher {
+	return &dispatcher{
+		mode:      opts.Dispatch,
+		workers:   opts.DispatchWorkers,
+		queueSize: opts.DispatchQueueSize,
+	}
+}
+
+// dispatcher calls a handler according to its dispatch mode, preserving per-user ordering.
+type dispatcher struct {
+	mode      DispatchMode
+	workers   int
+	queueSize int
+
+	// Workers shared by users in the pool, and the number of users assigned to them
+	pool      []chan func()
+	poolUsers int
+	poolMut   sync.Mutex
+}
+
+// Prepare a user's queue, before any calls are dispatched for them.
+func (d *dispatcher) start(usr *User) {
+	switch d.mode {
+	case DispatchPerUser:
+		usr.queue = d.work(d.queueSize)
+	case DispatchPool:
+		// Pool is started lazily to avoid creating routines for parties using channels,
+		// and stopped once the party is empty, so discarded parties don't leak them.
+		d.poolMut.Lock()
+		defer d.poolMut.Unlock()
+		if d.pool == nil {
+			workers := d.workers
+			if workers <= 0 {
+				workers = runtime.NumCPU()
+			}
+			d.pool = make([]chan func(), workers)
+			for i := range d.pool {
+				d.pool[i] = d.work(d.queueSize)
+			}
+		}
+		d.poolUsers++
+		hash := fnv.New32a()
+		hash.Write([]byte(usr.ID))
+		usr.queue = d.pool[hash.Sum32()%uint32(len(d.pool))]
+	}
+}
+
+// Dispatch a call for the user.
+func (d *dispatcher) dispatch(usr *User, call func()) {
+	if usr.queue == nil {
+		call()
+		return
+	}
+	usr.queue <- call
+}
+
+// Stop a user's queue once all of their calls are dispatched.
+func (d *dispatcher) stop(usr *User) {
+	if usr.queue == nil {
+		return
+	}
+	switch d.mode {
+	case DispatchPerUser:
+		close(usr.queue)
+	case DispatchPool:
+		d.poolMut.Lock()
+		defer d.poolMut.Unlock()
+		d.poolUsers--
+		if d.poolUsers == 0 {
+			for _, queue := range d.pool {
+				close(queue)
+			}
+			d.pool = nil
+		}
+	}
+}
+
+// Create a queue, with a routine calling everything sent into it until it is closed.
+func (d *dispatcher) work(size int) chan func() {
+	queue := make(chan func(), size)
+	go func() {
+		for call := range queue {
+			call()
+		}
+	}()
+	return queue
+}
+
+/*
+SetHandler sets the handler to be called with the party's events, replacing the previous if any.
+It is called according to the Dispatch option, and is safe to call at any time.
+*/
+func (party *Party) SetHandler(handler Handler) {
+	party.mut.Lock()
+	defer party.mut.Unlock()
+	party.handler = handler
+}
+
+func (party *Party) getHandler() Handler {
+	party.mut.RLock()
+	defer party.mut.RUnlock()
+	return party.handler
+}
+
+// Dispatch a call to the handler for the user, if one is set.
+func (party *Party) dispatch(usr *User, call func(handler Handler)) {
+	party.dispatcher.dispatch(usr, func() {
+		if handler := party.getHandler(); handler != nil {
+			call(handler)
+		}
+	})
+}
+
+// Report an error to the error handler, and the handler if set.
+func (party *Party) reportError(err error) {
+	party.ErrorHandler(err)
+	if handler := party.getHandler(); handler != nil {
+		handler.OnError(err)
+	}
+}
@@ -0,0 +1,80 @@
+package sockparty_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/posener/wstest"
+
+	"github.com/izzymg/sockparty"
+)
+
+// Handler recording calls in order.
+type recordingHandler struct {
+	calls chan string
+}
+
+func (h *recordingHandler) OnJoin(userID string) {
+	h.calls <- "join"
+}
+
+func (h *recordingHandler) OnLeave(userID string) {
+	h.calls <- "leave"
+}
+
+func (h *recordingHandler) OnMessage(message sockparty.Incoming) {
+	h.calls <- "message " + string(message.Event)
+}
+
+func (h *recordingHandler) OnError(err error) {}
+
+// Test handlers are called in order for a user, in every dispatch mode.
+func TestHandler(t *testing.T) {
+	modes := map[string]sockparty.DispatchMode{
+		"Inline":  sockparty.DispatchInline,
+		"PerUser": sockparty.DispatchPerUser,
+		"Pool":    sockparty.DispatchPool,
+	}
+
+	for name, mode := range modes {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+
+			party := sockparty.New(generateUID, &sockparty.Options{
+				PingFrequency:     0,
+				Dispatch:          mode,
+				DispatchWorkers:   2,
+				DispatchQueueSize: 4,
+			})
+			handler := &recordingHandler{calls: make(chan string, 16)}
+			party.SetHandler(handler)
+
+			d := wstest.NewDialer(party)
+			c, _, err := d.Dial(addr, nil)
+			is.NoErr(err)
+
+			messageCount := 5
+			for i := 0; i < messageCount; i++ {
+				is.NoErr(c.WriteJSON(&sockparty.Outgoing{Event: sockparty.Event(fmt.Sprint(i))}))
+			}
+			c.Close()
+
+			is.Equal(<-handler.calls, "join")
+			for i := 0; i < messageCount; i++ {
+				is.Equal(<-handler.calls, fmt.Sprintf("message %d", i))
+			}
+			is.Equal(<-handler.calls, "leave")
+
+			// Ending the party fires leave, and the party can be joined again.
+			c, _, err = wstest.NewDialer(party).Dial(addr, nil)
+			is.NoErr(err)
+			defer c.Close()
+			readMessages(c)
+			is.Equal(<-handler.calls, "join")
+			party.End("Bye")
+			is.Equal(<-handler.calls, "leave")
+		})
+	}
+}
@@ -0,0 +1,274 @@
+package sockparty
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* Clients behind proxies which break WebSocket upgrades can join over Server-Sent Events,
+with the AllowEventStream option. The client opens an event stream with a GET request
+accepting text/event-stream, and is sent a session event holding its session token.
+Messages are sent to the client as data events, holding the same JSON as WebSocket messages,
+binary messages as base64 binary events. The client sends messages by POSTing them to the
+same URL with the session query parameter, JSON as is, binary with the content type
+application/octet-stream. Closing the stream leaves the party, and when the party closes
+the connection, the client is sent a close event with the status code and reason. */
+
+// Returned when writing to or pinging an event stream whose client has disconnected.
+var errStreamGone = errors.New("Event stream client disconnected")
+
+const (
+	eventStreamType = "text/event-stream"
+	sessionParam    = "session"
+	// Subprotocols requested by event stream clients, separated by commas.
+	subprotocolParam = "subprotocol"
+)
+
+// Returns true if the request is for an event stream, or posting to one.
+func isEventStream(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet:
+		return strings.Contains(req.Header.Get("Accept"), eventStreamType)
+	case http.MethodPost:
+		return req.URL.Query().Get(sessionParam) != ""
+	}
+	return false
+}
+
+func (party *Party) serveEventStream(rw http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPost {
+		party.receiveEventStream(rw, req)
+		return
+	}
+
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		party.reportError(errors.New("failed to open event stream: http.ResponseWriter does not implement http.Flusher"))
+		http.Error(rw, "Event streams unsupported", http.StatusInternalServerError)
+		return
+	}
+	session, err := newTransferID()
+	if err != nil {
+		party.reportError(fmt.Errorf("failed to open event stream: %v", err))
+		http.Error(rw, "Event stream failed", http.StatusInternalServerError)
+		return
+	}
+	conn := &eventStreamConn{
+		rw:          rw,
+		flusher:     flusher,
+		subprotocol: party.opts.negotiateSubprotocol(req.URL.Query().Get(subprotocolParam)),
+		incoming:    make(chan eventStreamMessage),
+		writes:      make(chan eventStreamWrite),
+		gone:        req.Context().Done(),
+		closed:      make(chan struct{}),
+	}
+
+	rw.Header().Set("Content-Type", eventStreamType)
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	err = conn.writeNow(formatEvent("session", []byte(session)))
+	if err != nil {
+		party.reportError(fmt.Errorf("failed to open event stream: %v", err))
+		return
+	}
+
+	party.sessions.Store(session, conn)
+	defer party.sessions.Delete(session)
+	// The response is only written from this routine, so the user's writes can give up
+	// on a stuck client without the handler returning under them.
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		party.serveConn(req, conn)
+	}()
+	conn.writeLoop(served)
+}
+
+// Receive a message posted by an event stream client.
+func (party *Party) receiveEventStream(rw http.ResponseWriter, req *http.Request) {
+	c, ok := party.sessions.Load(req.URL.Query().Get(sessionParam))
+	if !ok {
+		http.Error(rw, "No such session", http.StatusNotFound)
+		return
+	}
+	conn := c.(*eventStreamConn)
+
+	limit := party.opts.ReadLimit
+	if limit <= 0 {
+		limit = defaultReadLimit
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(rw, req.Body, limit))
+	if err != nil {
+		http.Error(rw, "Message too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	message := eventStreamMessage{typ: MessageText, data: data}
+	if req.Header.Get("Content-Type") == "application/octet-stream" {
+		message.typ = MessageBinary
+	}
+
+	// Wait for the user to read the message, as the WebSocket would.
+	select {
+	case conn.incoming <- message:
+		rw.WriteHeader(http.StatusAccepted)
+	case <-conn.closed:
+		http.Error(rw, "Session closed", http.StatusGone)
+	case <-req.Context().Done():
+	}
+}
+
+// Choose the first of the options' subprotocols requested by the client, empty if none.
+func (opts *Options) negotiateSubprotocol(requested string) string {
+	for _, subprotocol := range opts.Subprotocols {
+		for _, r := range strings.Split(requested, ",") {
+			if strings.TrimSpace(r) == subprotocol {
+				return subprotocol
+			}
+		}
+	}
+	return ""
+}
+
+// Default maximum size of a message posted to an event stream, as for WebSocket.
+const defaultReadLimit = 32768
+
+type eventStreamMessage struct {
+	typ  MessageType
+	data []byte
+}
+
+// A write to the stream, and where its result is sent.
+type eventStreamWrite struct {
+	p    []byte
+	done chan error
+}
+
+// eventStreamConn is a user's connection over an event stream, receiving posted messages.
+type eventStreamConn struct {
+	rw          http.ResponseWriter
+	flusher     http.Flusher
+	subprotocol string
+	incoming    chan eventStreamMessage
+	writes      chan eventStreamWrite
+	// Closed when the client disconnects.
+	gone <-chan struct{}
+
+	// Closed when the connection is closed, with the close status.
+	closed    chan struct{}
+	closeErr  error
+	closeOnce sync.Once
+}
+
+func (c *eventStreamConn) ReadMessage(ctx context.Context) (MessageType, []byte, error) {
+	select {
+	case message := <-c.incoming:
+		return message.typ, message.data, nil
+	case <-c.closed:
+		return 0, nil, c.closeErr
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	}
+}
+
+func (c *eventStreamConn) WriteMessage(ctx context.Context, typ MessageType, data []byte) error {
+	if typ == MessageBinary {
+		return c.write(ctx, formatEvent("binary", []byte(base64.StdEncoding.EncodeToString(data))))
+	}
+	return c.write(ctx, formatEvent("", data))
+}
+
+/*
+Ping writes a comment to the stream, which also keeps proxies from timing it out.
+It fails if the client has disconnected, or the comment can't be written before the context ends.
+*/
+func (c *eventStreamConn) Ping(ctx context.Context) error {
+	select {
+	case <-c.gone:
+		return errStreamGone
+	default:
+	}
+	return c.write(ctx, []byte(": ping\n\n"))
+}
+
+// Close sends the client a close event, and ends the stream.
+func (c *eventStreamConn) Close(code StatusCode, reason string) error {
+	err := errors.New("Event stream already closed")
+	c.closeOnce.Do(func() {
+		data, _ := json.Marshal(struct {
+			Code   StatusCode `json:"code"`
+			Reason string     `json:"reason"`
+		}{code, reason})
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		err = c.write(ctx, formatEvent("close", data))
+		c.closeErr = CloseError{Code: code, Reason: reason}
+		close(c.closed)
+	})
+	return err
+}
+
+func (c *eventStreamConn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// Format an event for the stream, with the data split into lines. Unnamed events are messages.
+func formatEvent(event string, data []byte) []byte {
+	var b strings.Builder
+	if event != "" {
+		b.WriteString("event: " + event + "\n")
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+	return []byte(b.String())
+}
+
+// Hand a write to the stream's write loop, giving up when the context ends.
+func (c *eventStreamConn) write(ctx context.Context, p []byte) error {
+	w := eventStreamWrite{p: p, done: make(chan error, 1)}
+	select {
+	case c.writes <- w:
+	case <-c.closed:
+		return c.closeErr
+	case <-c.gone:
+		return errStreamGone
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-w.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Write to the stream until done is closed. A stuck write holds up the loop, not its writer.
+func (c *eventStreamConn) writeLoop(done <-chan struct{}) {
+	for {
+		select {
+		case w := <-c.writes:
+			w.done <- c.writeNow(w.p)
+		case <-done:
+			return
+		}
+	}
+}
+
+func (c *eventStreamConn) writeNow(p []byte) error {
+	_, err := c.rw.Write(p)
+	if err != nil {
+		return fmt.Errorf("Write to event stream failed: %w", err)
+	}
+	c.flusher.Flush()
+	return nil
+}
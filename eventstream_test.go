@@ -0,0 +1,164 @@
+package sockparty_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"github.com/izzymg/sockparty"
+	"github.com/izzymg/sockparty/sockpartytest"
+)
+
+type streamEvent struct {
+	event string
+	data  string
+}
+
+// Read server-sent events from the body.
+func readEvents(body *bufio.Reader) <-chan streamEvent {
+	events := make(chan streamEvent, 16)
+	go func() {
+		defer close(events)
+		ev := streamEvent{}
+		var data []string
+		for {
+			line, err := body.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case line == "":
+				if data != nil {
+					ev.data = strings.Join(data, "\n")
+					events <- ev
+				}
+				ev, data = streamEvent{}, nil
+			case strings.HasPrefix(line, "event: "):
+				ev.event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				data = append(data, strings.TrimPrefix(line, "data: "))
+			}
+		}
+	}()
+	return events
+}
+
+// Test clients join over event streams, posting their messages.
+func TestEventStream(t *testing.T) {
+	is := is.New(t)
+
+	party := sockparty.New(generateUID, &sockparty.Options{
+		PingFrequency:    0,
+		AllowEventStream: true,
+		Subprotocols:     []string{"v2", "v1"},
+	})
+	recorder := sockpartytest.Record(party)
+	defer recorder.Stop()
+	server := httptest.NewServer(party)
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"?subprotocol=v1,v2", nil)
+	is.NoErr(err)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	is.NoErr(err)
+	defer resp.Body.Close()
+	is.Equal(resp.Header.Get("Content-Type"), "text/event-stream")
+	events := readEvents(bufio.NewReader(resp.Body))
+
+	session := <-events
+	is.Equal(session.event, "session")
+	id, err := recorder.ExpectJoin()
+	is.NoErr(err)
+	usr, err := party.GetUser(id)
+	is.NoErr(err)
+	is.Equal(usr.Subprotocol(), "v2")
+
+	// Client to server
+	post := func(contentType string, body []byte) int {
+		resp, err := http.Post(server.URL+"?session="+session.data, contentType, bytes.NewReader(body))
+		is.NoErr(err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	is.Equal(post("application/json", []byte(`{"event": "chat_message", "payload": "hi"}`)), http.StatusAccepted)
+	incoming, err := recorder.ExpectIncoming()
+	is.NoErr(err)
+	is.Equal(incoming.UserID, id)
+	is.Equal(string(incoming.Payload), `"hi"`)
+	is.Equal(post("application/octet-stream", []byte{0xca, 0xfe}), http.StatusAccepted)
+	binary, err := recorder.ExpectBinary()
+	is.NoErr(err)
+	is.Equal(binary.Data, []byte{0xca, 0xfe})
+
+	// Server to client
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	is.NoErr(party.Broadcast(ctx, &sockparty.Outgoing{Event: "chat_message", Payload: "hello"}))
+	message := <-events
+	is.Equal(message.event, "")
+	is.Equal(message.data, `{"event":"chat_message","payload":"hello"}`)
+	is.NoErr(party.SendBinary(ctx, id, []byte{0xbe, 0xef}))
+	message = <-events
+	is.Equal(message.event, "binary")
+	is.Equal(message.data, base64.StdEncoding.EncodeToString([]byte{0xbe, 0xef}))
+
+	// Closing sends the status, and ends the stream.
+	is.NoErr(party.Kick(id, "Bye"))
+	message = <-events
+	is.Equal(message.event, "close")
+	is.Equal(message.data, `{"code":1008,"reason":"Bye"}`)
+	_, ok := <-events
+	is.True(!ok)
+	_, err = recorder.ExpectLeave()
+	is.NoErr(err)
+	is.Equal(post("application/json", []byte(`{"event": "chat_message"}`)), http.StatusNotFound)
+}
+
+// Test event streams are only accepted when allowed.
+func TestEventStreamDisallowed(t *testing.T) {
+	is := is.New(t)
+
+	party := sockparty.New(generateUID, &sockparty.Options{
+		PingFrequency: 0,
+	})
+	server := httptest.NewServer(party)
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	is.NoErr(err)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	is.NoErr(err)
+	resp.Body.Close()
+	is.Equal(resp.StatusCode, http.StatusUpgradeRequired)
+}
+
+// Test posting to an unknown session is refused without reporting an error.
+func TestEventStreamUnknownSession(t *testing.T) {
+	is := is.New(t)
+
+	party := sockparty.New(generateUID, &sockparty.Options{
+		PingFrequency:    0,
+		AllowEventStream: true,
+	})
+	party.ErrorHandler = func(err error) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	server := httptest.NewServer(party)
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"?session=nope", "application/json", strings.NewReader(`{"event": "chat_message"}`))
+	is.NoErr(err)
+	resp.Body.Close()
+	is.Equal(resp.StatusCode, http.StatusNotFound)
+}
@@ -5,9 +5,11 @@ go 1.13
 require (
 	github.com/google/uuid v1.1.1
 	github.com/gorilla/websocket v1.4.1
+	github.com/kr/pretty v0.1.0 // indirect
 	github.com/matryer/is v1.2.0
 	github.com/posener/wstest v1.2.0
 	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e
-	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4
-	nhooyr.io/websocket v1.7.4
+	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
+	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
+	nhooyr.io/websocket v1.8.7
 )
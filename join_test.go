@@ -0,0 +1,143 @@
+package sockparty_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"nhooyr.io/websocket"
+
+	"github.com/izzymg/sockparty"
+	"github.com/izzymg/sockparty/sockpartytest"
+)
+
+// Test users join over connections accepted by the application.
+func TestJoin(t *testing.T) {
+	is := is.New(t)
+
+	party := sockparty.New(generateUID, &sockparty.Options{
+		PingFrequency: 0,
+	})
+	recorder := sockpartytest.Record(party)
+	defer recorder.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	clientEnd, serverEnd := sockpartytest.Pipe()
+	joined := make(chan error, 1)
+	go func() {
+		joined <- party.Join(ctx, serverEnd, sockparty.UserInfo{
+			ID:    "alice",
+			Name:  "Alice",
+			Roles: []sockparty.Role{"host"},
+		})
+	}()
+	id, err := recorder.ExpectJoin()
+	is.NoErr(err)
+	is.Equal(id, "alice")
+	usr, err := party.GetUser("alice")
+	is.NoErr(err)
+	is.Equal(usr.Name, "Alice")
+	is.True(usr.HasRole("host"))
+
+	c := sockpartytest.NewClient(clientEnd)
+	is.NoErr(c.Send("chat_message", "hi"))
+	incoming, err := recorder.ExpectIncoming()
+	is.NoErr(err)
+	is.Equal(incoming.UserID, "alice")
+
+	// IDs are unique.
+	_, duplicate := sockpartytest.Pipe()
+	is.True(errors.Is(party.Join(ctx, duplicate, sockparty.UserInfo{ID: "alice"}), sockparty.ErrUserExists))
+
+	// Join returns once the user leaves.
+	is.NoErr(c.Close())
+	var closeErr sockparty.CloseError
+	is.True(errors.As(<-joined, &closeErr))
+	is.Equal(closeErr.Code, sockparty.StatusNormalClosure)
+	_, err = recorder.ExpectLeave()
+	is.NoErr(err)
+}
+
+// Test applications upgrade requests themselves, then join the party.
+func TestJoinUpgraded(t *testing.T) {
+	is := is.New(t)
+
+	party := sockparty.New(generateUID, &sockparty.Options{
+		PingFrequency: 0,
+	})
+	recorder := sockpartytest.Record(party)
+	defer recorder.Stop()
+
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		conn, err := websocket.Accept(rw, req, nil)
+		if err != nil {
+			return
+		}
+		party.Join(req.Context(), sockparty.WebSocketConn(conn), sockparty.UserInfo{})
+	})
+
+	c, err := sockpartytest.Dial(handler)
+	is.NoErr(err)
+	defer c.Close()
+	id, err := recorder.ExpectJoin()
+	is.NoErr(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	is.NoErr(party.Message(ctx, id, &sockparty.Outgoing{Event: "welcome"}))
+	_, err = c.Expect("welcome")
+	is.NoErr(err)
+}
+
+// heldConn holds back a connection's read error until released.
+type heldConn struct {
+	sockparty.Conn
+	release chan struct{}
+}
+
+func (c heldConn) ReadMessage(ctx context.Context) (sockparty.MessageType, []byte, error) {
+	typ, data, err := c.Conn.ReadMessage(ctx)
+	if err != nil {
+		<-c.release
+	}
+	return typ, data, err
+}
+
+// Test a user leaving late doesn't remove a newer user who joined with their ID.
+func TestJoinAfterEnd(t *testing.T) {
+	is := is.New(t)
+
+	party := sockparty.New(generateUID, &sockparty.Options{
+		PingFrequency: 0,
+	})
+	recorder := sockpartytest.Record(party)
+	defer recorder.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	join := func(conn sockparty.Conn, name string) {
+		go party.Join(ctx, conn, sockparty.UserInfo{ID: "alice", Name: name})
+		id, err := recorder.ExpectJoin()
+		is.NoErr(err)
+		is.Equal(id, "alice")
+	}
+	_, first := sockpartytest.Pipe()
+	release := make(chan struct{})
+	join(heldConn{Conn: first, release: release}, "First")
+
+	// The first user is still leaving when the second joins.
+	party.End("Bye")
+	_, second := sockpartytest.Pipe()
+	join(second, "Second")
+	close(release)
+	_, err := recorder.ExpectLeave()
+	is.NoErr(err)
+
+	usr, err := party.GetUser("alice")
+	is.NoErr(err)
+	is.Equal(usr.Name, "Second")
+}
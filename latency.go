@@ -0,0 +1,66 @@
+package sockparty
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Smoothing factors for round-trip-time estimation, as used by TCP's retransmission timer (RFC 6298).
+const (
+	latencyAlpha = 0.125
+	latencyBeta  = 0.25
+)
+
+// Latency holds round-trip-time measurements taken by pinging a user.
+type Latency struct {
+	// Round trip time of the most recent ping.
+	Last time.Duration
+	// Smoothed average of the round trip time.
+	Average time.Duration
+	// Smoothed mean deviation of the round trip time.
+	Jitter time.Duration
+	// Number of pings measured.
+	Samples int
+}
+
+// add returns the latency updated with a new round trip time sample.
+func (l Latency) add(rtt time.Duration) Latency {
+	if l.Samples == 0 {
+		return Latency{
+			Last:    rtt,
+			Average: rtt,
+			Jitter:  rtt / 2,
+			Samples: 1,
+		}
+	}
+
+	deviation := l.Average - rtt
+	if deviation < 0 {
+		deviation = -deviation
+	}
+	return Latency{
+		Last:    rtt,
+		Average: time.Duration((1-latencyAlpha)*float64(l.Average) + latencyAlpha*float64(rtt)),
+		Jitter:  time.Duration((1-latencyBeta)*float64(l.Jitter) + latencyBeta*float64(deviation)),
+		Samples: l.Samples + 1,
+	}
+}
+
+// MarshalJSON encodes the latency with durations in milliseconds, for clients.
+func (l Latency) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Last    float64 `json:"last"`
+		Average float64 `json:"average"`
+		Jitter  float64 `json:"jitter"`
+		Samples int     `json:"samples"`
+	}{
+		Last:    durationMillis(l.Last),
+		Average: durationMillis(l.Average),
+		Jitter:  durationMillis(l.Jitter),
+		Samples: l.Samples,
+	})
+}
+
+func durationMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
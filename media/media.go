@@ -0,0 +1,265 @@
+/*
+Package media implements server-authoritative media playback synchronization on top of a SockParty.
+
+The player keeps the playback state (media, play/pause, position and rate), stamped with the
+server's time, in the party's shared state so every user mirrors it. Permitted users control
+playback by sending control events, and clients report their playback position so the server
+can nudge those drifting too far from where they should be.
+*/
+package media
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/izzymg/sockparty"
+)
+
+// ErrNotPermitted is returned when a user without permission attempts to control playback.
+var ErrNotPermitted = errors.New("User is not permitted to control playback")
+
+// Events used by the player.
+const (
+	// EventLoad is sent by clients to load new media, with a Control payload.
+	EventLoad sockparty.Event = "media:load"
+	// EventPlay is sent by clients to resume playback.
+	EventPlay sockparty.Event = "media:play"
+	// EventPause is sent by clients to pause playback.
+	EventPause sockparty.Event = "media:pause"
+	// EventSeek is sent by clients to seek, with a Control payload.
+	EventSeek sockparty.Event = "media:seek"
+	// EventRate is sent by clients to change the playback rate, with a Control payload.
+	EventRate sockparty.Event = "media:rate"
+	// EventPosition is sent by clients to report their playback position, with a Control payload.
+	EventPosition sockparty.Event = "media:position"
+	// EventSync is sent to clients with the current Playback, stamped with the server's time.
+	EventSync sockparty.Event = "media:sync"
+)
+
+// DefaultOptions generates player options with defaults.
+func DefaultOptions() *Options {
+	return &Options{
+		StateKey:       "media",
+		SyncInterval:   time.Second * 10,
+		DriftTolerance: time.Millisecond * 500,
+	}
+}
+
+// Options configures a player's settings.
+type Options struct {
+	// Key the playback is stored under in the party's shared state.
+	StateKey string
+
+	// Determines how frequently playback is broadcast to users while running. Set to zero to disable.
+	SyncInterval time.Duration
+	// Determines how far a client's reported position may drift before it is sent a sync.
+	DriftTolerance time.Duration
+
+	// Determines whether a user may control playback. If nil, anyone may.
+	CanControl func(userID string) bool
+}
+
+/*
+Control is the payload of control events from clients. Media is used by load,
+Position by seek and position reports, and Rate by rate changes.
+Positions are in seconds.
+*/
+type Control struct {
+	Media    string  `json:"media"`
+	Position float64 `json:"position"`
+	Rate     float64 `json:"rate"`
+}
+
+/*
+Playback is the authoritative playback state. Position is in seconds, as of UpdatedAt,
+in milliseconds since the Unix epoch on the server's clock. While playing, clients
+should be at Position + (now - UpdatedAt) * Rate.
+*/
+type Playback struct {
+	Media     string  `json:"media"`
+	Playing   bool    `json:"playing"`
+	Position  float64 `json:"position"`
+	Rate      float64 `json:"rate"`
+	UpdatedAt float64 `json:"updated_at"`
+}
+
+// PositionAt returns where playback is at time t.
+func (pb Playback) PositionAt(t time.Time) float64 {
+	if !pb.Playing {
+		return pb.Position
+	}
+	elapsed := (sockparty.UnixMillis(t) - pb.UpdatedAt) / 1000
+	return pb.Position + elapsed*pb.Rate
+}
+
+// NewPlayer creates a player synchronizing playback between users of the party. Nil options use DefaultOptions.
+func NewPlayer(party *sockparty.Party, options *Options) *Player {
+	if options == nil {
+		options = DefaultOptions()
+	}
+	return &Player{
+		party: party,
+		opts:  options,
+		playback: Playback{
+			Rate:      1,
+			UpdatedAt: sockparty.UnixMillis(party.Clock().Now()),
+		},
+	}
+}
+
+// Player synchronizes media playback for a party.
+type Player struct {
+	party    *sockparty.Party
+	opts     *Options
+	playback Playback
+	mut      sync.Mutex
+}
+
+// Playback returns the current playback state.
+func (player *Player) Playback() Playback {
+	player.mut.Lock()
+	defer player.mut.Unlock()
+	return player.playback
+}
+
+// Load loads new media, paused at the beginning.
+func (player *Player) Load(ctx context.Context, media string) error {
+	return player.update(ctx, func(pb *Playback, now time.Time) {
+		pb.Media = media
+		pb.Playing = false
+		pb.Position = 0
+	})
+}
+
+// Play resumes playback.
+func (player *Player) Play(ctx context.Context) error {
+	return player.update(ctx, func(pb *Playback, now time.Time) {
+		pb.Position = pb.PositionAt(now)
+		pb.Playing = true
+	})
+}
+
+// Pause pauses playback.
+func (player *Player) Pause(ctx context.Context) error {
+	return player.update(ctx, func(pb *Playback, now time.Time) {
+		pb.Position = pb.PositionAt(now)
+		pb.Playing = false
+	})
+}
+
+// Seek moves playback to position, in seconds.
+func (player *Player) Seek(ctx context.Context, position float64) error {
+	if position < 0 {
+		position = 0
+	}
+	return player.update(ctx, func(pb *Playback, now time.Time) {
+		pb.Position = position
+	})
+}
+
+// SetRate changes the playback rate.
+func (player *Player) SetRate(ctx context.Context, rate float64) error {
+	if rate <= 0 {
+		return fmt.Errorf("Invalid playback rate: %v", rate)
+	}
+	return player.update(ctx, func(pb *Playback, now time.Time) {
+		pb.Position = pb.PositionAt(now)
+		pb.Rate = rate
+	})
+}
+
+/*
+Handle processes an incoming message if it is a media event, returning false if it isn't.
+Pass all incoming messages from the party through this before handling them yourself.
+Control events from users who aren't permitted return ErrNotPermitted.
+*/
+func (player *Player) Handle(ctx context.Context, message sockparty.Incoming) (bool, error) {
+	switch message.Event {
+	case EventLoad, EventPlay, EventPause, EventSeek, EventRate, EventPosition:
+	default:
+		return false, nil
+	}
+
+	control := Control{}
+	if len(message.Payload) > 0 {
+		err := json.Unmarshal(message.Payload, &control)
+		if err != nil {
+			return true, fmt.Errorf("Invalid media control payload: %w", err)
+		}
+	}
+
+	// Anyone may report their position.
+	if message.Event == EventPosition {
+		return true, player.checkDrift(ctx, message.UserID, control.Position)
+	}
+
+	if player.opts.CanControl != nil && !player.opts.CanControl(message.UserID) {
+		return true, ErrNotPermitted
+	}
+	switch message.Event {
+	case EventLoad:
+		return true, player.Load(ctx, control.Media)
+	case EventPlay:
+		return true, player.Play(ctx)
+	case EventPause:
+		return true, player.Pause(ctx)
+	case EventSeek:
+		return true, player.Seek(ctx, control.Position)
+	default:
+		return true, player.SetRate(ctx, control.Rate)
+	}
+}
+
+// Run periodically broadcasts the playback to all users, blocking until the context is canceled.
+func (player *Player) Run(ctx context.Context) {
+	if player.opts.SyncInterval <= 0 {
+		<-ctx.Done()
+		return
+	}
+	ticker := player.party.Clock().NewTicker(player.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			player.party.Broadcast(ctx, player.sync())
+		}
+	}
+}
+
+// Apply a change to the playback, stamp it, and publish it to the party's state.
+func (player *Player) update(ctx context.Context, change func(pb *Playback, now time.Time)) error {
+	player.mut.Lock()
+	defer player.mut.Unlock()
+
+	now := player.party.Clock().Now()
+	change(&player.playback, now)
+	player.playback.UpdatedAt = sockparty.UnixMillis(now)
+	return player.party.State().Set(ctx, player.opts.StateKey, player.playback)
+}
+
+// Send a sync to a user if their reported position is too far from the server's.
+func (player *Player) checkDrift(ctx context.Context, userID string, position float64) error {
+	expected := player.Playback().PositionAt(player.party.Clock().Now())
+	drift := time.Duration((position - expected) * float64(time.Second))
+	if drift < 0 {
+		drift = -drift
+	}
+	if drift <= player.opts.DriftTolerance {
+		return nil
+	}
+	return player.party.Message(ctx, userID, player.sync())
+}
+
+// Create a sync message with the current playback.
+func (player *Player) sync() *sockparty.Outgoing {
+	return (&sockparty.Outgoing{
+		Event:   EventSync,
+		Payload: player.Playback(),
+	}).StampAt(player.party.Clock().Now())
+}
@@ -0,0 +1,133 @@
+package media_test
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"github.com/izzymg/sockparty"
+	"github.com/izzymg/sockparty/media"
+	"github.com/izzymg/sockparty/sockpartytest"
+)
+
+// Test permitted users control playback, which is replicated and nudged to drifting users.
+func TestPlayer(t *testing.T) {
+	is := is.New(t)
+
+	party := sockparty.New(sockpartytest.SequentialIDs("user"), &sockparty.Options{
+		PingFrequency: 0,
+	})
+	incoming := make(chan sockparty.Incoming)
+	joined := make(chan string)
+	party.RegisterIncoming(incoming)
+	party.RegisterOnUserJoined(joined)
+
+	options := media.DefaultOptions()
+	options.CanControl = func(userID string) bool {
+		return userID == "user1"
+	}
+	player := media.NewPlayer(party, options)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	handled := make(chan error)
+	go func() {
+		for m := range incoming {
+			_, err := player.Handle(ctx, m)
+			handled <- err
+		}
+	}()
+
+	host, err := sockpartytest.Dial(party)
+	is.NoErr(err)
+	defer host.Close()
+	is.Equal(<-joined, "user1")
+	guest, err := sockpartytest.Dial(party)
+	is.NoErr(err)
+	defer guest.Close()
+	is.Equal(<-joined, "user2")
+
+	// Host loads media, which everyone sees.
+	is.NoErr(host.Send(media.EventLoad, media.Control{Media: "video.mp4"}))
+	is.NoErr(<-handled)
+	_, err = guest.Expect(sockparty.EventStatePatch)
+	is.NoErr(err)
+	is.Equal(player.Playback().Media, "video.mp4")
+
+	// Guest can't control playback.
+	is.NoErr(guest.Send(media.EventPlay, nil))
+	is.Equal(<-handled, media.ErrNotPermitted)
+	is.True(!player.Playback().Playing)
+
+	// Host can.
+	is.NoErr(host.Send(media.EventPlay, nil))
+	is.NoErr(<-handled)
+	_, err = host.Expect(sockparty.EventStatePatch)
+	is.NoErr(err)
+	is.True(player.Playback().Playing)
+
+	// Guest reports a position far ahead, and is nudged back.
+	is.NoErr(guest.Send(media.EventPosition, media.Control{Position: 100}))
+	is.NoErr(<-handled)
+	m, err := guest.Expect(media.EventSync)
+	is.NoErr(err)
+	var playback media.Playback
+	is.NoErr(m.Decode(&playback))
+	is.True(playback.Playing)
+	is.True(playback.PositionAt(time.Now()) < 100)
+
+	// Other events aren't handled.
+	ok, err := player.Handle(ctx, sockparty.Incoming{Event: "chat_message"})
+	is.NoErr(err)
+	is.True(!ok)
+}
+
+// Test playback is broadcast on the party's clock.
+func TestRun(t *testing.T) {
+	is := is.New(t)
+
+	start := time.Unix(1000, 0)
+	clock := sockpartytest.NewFakeClock(start)
+	party := sockparty.New(sockpartytest.SequentialIDs("user"), &sockparty.Options{
+		PingFrequency: 0,
+		Clock:         clock,
+	})
+	recorder := sockpartytest.Record(party)
+	defer recorder.Stop()
+	// Options default when nil.
+	player := media.NewPlayer(party, nil)
+	is.Equal(player.Playback().UpdatedAt, sockparty.UnixMillis(start))
+
+	c, err := sockpartytest.Dial(party)
+	is.NoErr(err)
+	defer c.Close()
+	_, err = recorder.ExpectJoin()
+	is.NoErr(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go player.Run(ctx)
+	clock.BlockUntil(1)
+	clock.Advance(media.DefaultOptions().SyncInterval)
+	m, err := c.Expect(media.EventSync)
+	is.NoErr(err)
+	is.Equal(m.ServerTime, sockparty.UnixMillis(start.Add(media.DefaultOptions().SyncInterval)))
+}
+
+// Test playback position is calculated from the rate and time elapsed.
+func TestPositionAt(t *testing.T) {
+	is := is.New(t)
+	now := time.Now()
+	playback := media.Playback{
+		Playing:   true,
+		Position:  10,
+		Rate:      2,
+		UpdatedAt: sockparty.UnixMillis(now),
+	}
+	is.True(math.Abs(playback.PositionAt(now.Add(time.Second*5))-20) < 0.001)
+	playback.Playing = false
+	is.Equal(playback.PositionAt(now.Add(time.Second*5)), float64(10))
+}
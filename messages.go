@@ -2,11 +2,37 @@ package sockparty
 
 import (
 	"encoding/json"
+	"fmt"
+	"time"
 )
 
 // Event is a string representing a message's event type.
 type Event string
 
+/*
+Reserved events used by SockParty's own protocol. Consumers should
+avoid using the "sockparty:" prefix for their own events.
+*/
+const (
+	// EventLatency is sent to a user with their Latency after each ping, if enabled.
+	EventLatency Event = "sockparty:latency"
+	// EventTimeSync is a time sync exchange, see TimeSync.
+	EventTimeSync Event = "sockparty:timesync"
+	// EventState is a StateSnapshot, sent to users on join once state has been set.
+	// Users may send it to request a new snapshot.
+	EventState Event = "sockparty:state"
+	// EventStatePatch is a StatePatch, broadcast whenever the state changes.
+	EventStatePatch Event = "sockparty:state_patch"
+	// EventForbidden is sent to users who send an event they don't have the role for, see Forbidden.
+	EventForbidden Event = "sockparty:forbidden"
+	// EventChunk is a Chunk of a large payload, sent by Stream or uploaded by users.
+	EventChunk Event = "sockparty:chunk"
+	// EventSubscribe is sent by clients of a Mux to join a party, and replied to, see Subscription.
+	EventSubscribe Event = "sockparty:subscribe"
+	// EventUnsubscribe is sent by clients of a Mux to leave a party, and sent to them when they leave, see Subscription.
+	EventUnsubscribe Event = "sockparty:unsubscribe"
+)
+
 /*
 Incoming represents a socket message from a user, destined to the server.
 The UserID is the user who sent the message to the server.
@@ -22,8 +48,46 @@ type Incoming struct {
 Outgoing represents a message destined from the server to users.
 It contains an event to inform the client of the type of message,
 and the payload containing the actual message data of any type.
+ServerTime is optional, see Stamp.
+Messages default to PriorityNormal.
 */
 type Outgoing struct {
-	Event   Event       `json:"event"`
-	Payload interface{} `json:"payload"`
+	Event      Event       `json:"event"`
+	Payload    interface{} `json:"payload"`
+	ServerTime float64     `json:"server_time,omitempty"`
+	// Determines the order queued messages are written to each user, not sent to clients.
+	Priority Priority `json:"-"`
+}
+
+/*
+Stamp sets the message's server time to now, in milliseconds since the Unix epoch.
+Clients which have synced their clocks can use this to tell exactly when the message was sent.
+Use StampAt with the party's Clock for parties with a fake clock.
+*/
+func (o *Outgoing) Stamp() *Outgoing {
+	return o.StampAt(time.Now())
+}
+
+// StampAt sets the message's server time to t, see Stamp.
+func (o *Outgoing) StampAt(t time.Time) *Outgoing {
+	o.ServerTime = UnixMillis(t)
+	return o
+}
+
+/*
+PreparedMessage is an outgoing message encoded ahead of time, so it can be written
+to many users, or many times, without encoding it again.
+*/
+type PreparedMessage struct {
+	data     []byte
+	priority Priority
+}
+
+// NewPreparedMessage encodes an outgoing message.
+func NewPreparedMessage(message *Outgoing) (*PreparedMessage, error) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return nil, fmt.Errorf("Marshal JSON message failed: %w", err)
+	}
+	return &PreparedMessage{data: data, priority: message.Priority}, nil
 }
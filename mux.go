@@ -0,0 +1,521 @@
+package sockparty
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Errors returned to clients when subscribing to parties.
+var (
+	ErrNoSuchParty       = errors.New("No such party")
+	ErrAlreadySubscribed = errors.New("Already subscribed to party")
+	ErrPartyExists       = errors.New("A party with that name was already added")
+	ErrPartyNameTooLong  = fmt.Errorf("Party name is longer than %d bytes", maxPartyName)
+)
+
+// Binary messages hold the length of the party's name in one byte.
+const maxPartyName = 255
+
+/*
+Subscription is the payload of EventSubscribe and EventUnsubscribe messages.
+Clients send the party's name, and are replied to with an error if it failed.
+When a party closes the subscription, such as with Kick or End, the client is sent
+EventUnsubscribe with the status code and reason once the user has left the party,
+and the error if joining the party failed.
+*/
+type Subscription struct {
+	Party  string     `json:"party"`
+	Error  string     `json:"error,omitempty"`
+	Code   StatusCode `json:"code,omitempty"`
+	Reason string     `json:"reason,omitempty"`
+}
+
+/*
+Mux serves many parties over one connection per client. The client subscribes to parties
+by name with EventSubscribe, and unsubscribes with EventUnsubscribe, which are both replied to.
+Messages between the client and a party are tagged with the party's name in a "party" field
+alongside the event. Binary messages are prefixed with a byte holding the length of the party's
+name, then the name. Each subscription joins the party as a user, with the same ID in every party.
+The socket is pinged and rate limited once by the mux, rather than by each party, with its own
+limiter at the rate and burst of the options' RateLimiter. Messages to a party wait in a buffer of
+InboxSize, 16 if unset, for its user to read them, so a stalled party doesn't hold up the socket.
+When it's full, messages are dropped with BackpressureDrop, otherwise the client is unsubscribed.
+*/
+type Mux struct {
+	UIDGenerator UniqueIDGenerator
+	// Called when an error occurs within the mux.
+	ErrorHandler func(err error)
+
+	// Options for the clients' connections. Party options still apply to their users.
+	opts    *Options
+	parties map[string]*Party
+	mut     sync.RWMutex
+}
+
+/*
+NewMux creates a mux, which accepts connections, pings them, and rate limits them according to the
+options. Parties added to the mux don't ping or rate limit users subscribed through it.
+*/
+func NewMux(uidGenerator UniqueIDGenerator, options *Options) *Mux {
+	if options == nil {
+		options = DefaultOptions()
+	}
+	return &Mux{
+		UIDGenerator: uidGenerator,
+		ErrorHandler: func(e error) {},
+		opts:         options,
+		parties:      make(map[string]*Party),
+	}
+}
+
+// Add adds a party to the mux by its name, which must be unique and at most 255 bytes.
+func (mux *Mux) Add(party *Party) error {
+	if len(party.Name) > maxPartyName {
+		return fmt.Errorf("%w: %q", ErrPartyNameTooLong, party.Name)
+	}
+	mux.mut.Lock()
+	defer mux.mut.Unlock()
+	if _, ok := mux.parties[party.Name]; ok {
+		return fmt.Errorf("%w: %q", ErrPartyExists, party.Name)
+	}
+	mux.parties[party.Name] = party
+	return nil
+}
+
+// Remove removes a party from the mux by its name. Subscribed users remain in the party.
+func (mux *Mux) Remove(name string) {
+	mux.mut.Lock()
+	defer mux.mut.Unlock()
+	delete(mux.parties, name)
+}
+
+func (mux *Mux) getParty(name string) (*Party, bool) {
+	mux.mut.RLock()
+	defer mux.mut.RUnlock()
+	party, ok := mux.parties[name]
+	return party, ok
+}
+
+// ServeHTTP accepts a client's connection, serving its subscriptions until it closes.
+func (mux *Mux) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if !mux.opts.originAllowed(req) {
+		mux.ErrorHandler(fmt.Errorf("%w: %q", ErrOriginNotAllowed, req.Header.Get("Origin")))
+		http.Error(rw, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+	conn, err := mux.opts.transport().Accept(rw, req)
+	if err != nil {
+		mux.ErrorHandler(fmt.Errorf("failed to upgrade websocket connection: %v", err))
+		return
+	}
+	if mux.opts.CheckSubprotocol != nil && !mux.opts.CheckSubprotocol(conn.Subprotocol()) {
+		mux.ErrorHandler(fmt.Errorf("%w: %q", ErrUnsupportedSubprotocol, conn.Subprotocol()))
+		conn.Close(StatusPolicyViolation, "Unsupported subprotocol")
+		return
+	}
+	uid, err := mux.UIDGenerator()
+	if err != nil {
+		mux.ErrorHandler(fmt.Errorf("failed to generate unique ID: %v", err))
+		conn.Close(StatusInternalError, "User creation failed")
+		return
+	}
+
+	socket := &muxSocket{
+		mux:    mux,
+		conn:   conn,
+		req:    req,
+		userID: uid,
+		subs:   make(map[string]*muxConn),
+	}
+	err = socket.serve(req.Context())
+	if err != nil {
+		mux.ErrorHandler(err)
+	}
+}
+
+// muxSocket is a client's connection to a mux, shared by its subscriptions.
+type muxSocket struct {
+	mux    *Mux
+	conn   Conn
+	req    *http.Request
+	userID string
+
+	subs   map[string]*muxConn
+	closed bool
+	mut    sync.Mutex
+	// Guards writing to the connection
+	writeMut sync.Mutex
+}
+
+// Read from the socket, pinging it, until it closes. Then close every subscription.
+func (s *muxSocket) serve(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pinged := make(chan error, 1)
+	go func() {
+		err := s.pingLoop(ctx)
+		s.closeSubs(err)
+		cancel()
+		pinged <- err
+	}()
+	err := s.readLoop(ctx)
+	s.closeSubs(err)
+	cancel()
+	if pingErr := <-pinged; pingErr != nil && !errors.Is(pingErr, context.Canceled) {
+		err = pingErr
+	}
+	s.conn.Close(StatusNormalClosure, "")
+	return err
+}
+
+// Close every subscription because the socket closed, before their users try to tell the client.
+func (s *muxSocket) closeSubs(err error) {
+	closeErr := CloseError{Code: StatusGoingAway, Reason: disconnect}
+	errors.As(err, &closeErr)
+	s.mut.Lock()
+	s.closed = true
+	subs := s.subs
+	s.subs = make(map[string]*muxConn)
+	s.mut.Unlock()
+	for _, sub := range subs {
+		sub.end(closeErr)
+	}
+}
+
+func (s *muxSocket) readLoop(ctx context.Context) error {
+	opts := s.mux.opts
+	// Each socket has its own limiter, so one client flooding doesn't throttle the others.
+	limiter := rate.NewLimiter(rate.Inf, 1)
+	if opts.RateLimiter != nil {
+		limiter = rate.NewLimiter(opts.RateLimiter.Limit(), opts.RateLimiter.Burst())
+	}
+	for {
+		err := waitLimiter(ctx, opts.clock(), limiter)
+		if err != nil {
+			return err
+		}
+		typ, data, err := s.conn.ReadMessage(ctx)
+		if err != nil {
+			return err
+		}
+		if typ == MessageBinary {
+			name, data, err := untagBinary(data)
+			if err != nil {
+				return err
+			}
+			s.route(name, typ, data)
+			continue
+		}
+
+		var message struct {
+			Party   string          `json:"party"`
+			Event   Event           `json:"event"`
+			Payload json.RawMessage `json:"payload"`
+		}
+		err = json.Unmarshal(data, &message)
+		if err != nil {
+			return fmt.Errorf("Read JSON from user failed: %w", err)
+		}
+		if message.Party != "" {
+			s.route(message.Party, typ, data)
+			continue
+		}
+		switch message.Event {
+		case EventSubscribe, EventUnsubscribe:
+			sub := Subscription{}
+			err = json.Unmarshal(message.Payload, &sub)
+			if err != nil {
+				return fmt.Errorf("Invalid subscription payload: %w", err)
+			}
+			if message.Event == EventSubscribe {
+				err = s.subscribe(ctx, sub.Party)
+			} else {
+				err = s.unsubscribe(ctx, sub.Party)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Ping the socket until it fails to respond, or the context is canceled.
+func (s *muxSocket) pingLoop(ctx context.Context) error {
+	opts := s.mux.opts
+	if opts.PingFrequency <= 0 {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	clock := opts.clock()
+	ticker := clock.NewTicker(opts.PingFrequency)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C():
+			pingCtx, expired, cancel := withClockTimeout(ctx, clock, opts.PingTimeout)
+			err := s.conn.Ping(pingCtx)
+			cancel()
+			if err != nil {
+				select {
+				case <-expired:
+					err = context.DeadlineExceeded
+				default:
+				}
+				return fmt.Errorf("Ping failed: %w", err)
+			}
+		}
+	}
+}
+
+// Join the client to a party, replying whether it succeeded.
+func (s *muxSocket) subscribe(ctx context.Context, name string) error {
+	party, ok := s.mux.getParty(name)
+	if !ok {
+		return s.reply(ctx, EventSubscribe, Subscription{Party: name, Error: ErrNoSuchParty.Error()})
+	}
+	var roles []Role
+	if party.RoleAssigner != nil {
+		var err error
+		roles, err = party.RoleAssigner(s.req, s.userID)
+		if err != nil {
+			party.reportError(fmt.Errorf("failed to assign roles: %v", err))
+			return s.reply(ctx, EventSubscribe, Subscription{Party: name, Error: "User creation failed"})
+		}
+	}
+
+	s.mut.Lock()
+	if s.closed {
+		s.mut.Unlock()
+		return nil
+	}
+	if _, ok := s.subs[name]; ok {
+		s.mut.Unlock()
+		return s.reply(ctx, EventSubscribe, Subscription{Party: name, Error: ErrAlreadySubscribed.Error()})
+	}
+	sub := &muxConn{
+		socket:   s,
+		party:    name,
+		incoming: make(chan muxMessage, s.mux.inboxSize()),
+		closed:   make(chan struct{}),
+	}
+	s.subs[name] = sub
+	s.mut.Unlock()
+
+	// Reply before joining, so the reply comes before anything the party sends.
+	err := s.reply(ctx, EventSubscribe, Subscription{Party: name})
+	if err != nil {
+		return err
+	}
+	go s.serveSub(ctx, party, sub, roles)
+	return nil
+}
+
+// Join the subscription's user to the party until they leave, then remove it and tell the client.
+func (s *muxSocket) serveSub(ctx context.Context, party *Party, sub *muxConn, roles []Role) {
+	// The user leaves once the subscription closes, even if they're stuck waiting on the party.
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		defer cancel()
+		select {
+		case <-sub.closed:
+		case <-ctx.Done():
+		}
+	}()
+	err := party.Join(ctx, sub, UserInfo{ID: s.userID, Roles: roles})
+	cancel()
+	// Stop routing to the subscription, if the party didn't close it.
+	sub.end(CloseError{Code: StatusInternalError, Reason: "Left party"})
+	closeErr := sub.closeErr.(CloseError)
+	unsub := Subscription{Party: sub.party, Code: closeErr.Code, Reason: closeErr.Reason}
+	if err != nil && !errors.As(err, new(CloseError)) && !errors.Is(err, context.Canceled) {
+		unsub.Error = err.Error()
+	}
+	s.unsubscribed(sub, unsub)
+}
+
+// Leave a party, replying once left.
+func (s *muxSocket) unsubscribe(ctx context.Context, name string) error {
+	s.mut.Lock()
+	sub, ok := s.subs[name]
+	s.mut.Unlock()
+	if !ok {
+		return s.reply(ctx, EventUnsubscribe, Subscription{Party: name, Error: ErrNoSuchParty.Error()})
+	}
+	sub.Close(StatusNormalClosure, "Unsubscribed")
+	return nil
+}
+
+// Route a message from the client to its subscription, dropping messages to parties it isn't subscribed to.
+// Never blocks, so one subscription can't hold up the socket's others, or its pongs.
+func (s *muxSocket) route(name string, typ MessageType, data []byte) {
+	s.mut.Lock()
+	sub, ok := s.subs[name]
+	s.mut.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case sub.incoming <- muxMessage{typ: typ, data: data}:
+	case <-sub.closed:
+	default:
+		if s.mux.opts.Backpressure != BackpressureDrop {
+			sub.Close(StatusPolicyViolation, overloaded)
+		}
+	}
+}
+
+// Size of each subscription's buffer of messages from the client, as in DefaultOptions if unset.
+func (mux *Mux) inboxSize() int {
+	if mux.opts.InboxSize > 0 {
+		return mux.opts.InboxSize
+	}
+	return 16
+}
+
+// Remove a subscription whose user has left, and tell the client.
+func (s *muxSocket) unsubscribed(sub *muxConn, unsub Subscription) {
+	s.mut.Lock()
+	if s.subs[sub.party] != sub {
+		// The socket is closing.
+		s.mut.Unlock()
+		return
+	}
+	delete(s.subs, sub.party)
+	s.mut.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	s.reply(ctx, EventUnsubscribe, unsub)
+}
+
+// Send the client a message from the mux itself.
+func (s *muxSocket) reply(ctx context.Context, event Event, sub Subscription) error {
+	data, err := json.Marshal(&Outgoing{Event: event, Payload: sub})
+	if err != nil {
+		return err
+	}
+	return s.write(ctx, MessageText, data)
+}
+
+func (s *muxSocket) write(ctx context.Context, typ MessageType, data []byte) error {
+	s.writeMut.Lock()
+	defer s.writeMut.Unlock()
+	return s.conn.WriteMessage(ctx, typ, data)
+}
+
+type muxMessage struct {
+	typ  MessageType
+	data []byte
+}
+
+// muxConn is a client's subscription to a party, used as their connection to it.
+type muxConn struct {
+	socket   *muxSocket
+	party    string
+	incoming chan muxMessage
+
+	closed    chan struct{}
+	closeErr  error
+	closeOnce sync.Once
+}
+
+func (c *muxConn) ReadMessage(ctx context.Context) (MessageType, []byte, error) {
+	select {
+	case message := <-c.incoming:
+		return message.typ, message.data, nil
+	case <-c.closed:
+		return 0, nil, c.closeErr
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	}
+}
+
+// WriteMessage tags the message with the party's name, and writes it to the socket.
+func (c *muxConn) WriteMessage(ctx context.Context, typ MessageType, data []byte) error {
+	select {
+	case <-c.closed:
+		return c.closeErr
+	default:
+	}
+	if typ == MessageBinary {
+		return c.socket.write(ctx, typ, tagBinary(c.party, data))
+	}
+	tagged, err := tagJSON(c.party, data)
+	if err != nil {
+		return err
+	}
+	return c.socket.write(ctx, typ, tagged)
+}
+
+// Ping always succeeds, the socket is pinged by the mux.
+func (c *muxConn) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Close the subscription. The client is told they've been unsubscribed once the user has left the party.
+func (c *muxConn) Close(code StatusCode, reason string) error {
+	err := errors.New("Subscription already closed")
+	c.closeOnce.Do(func() {
+		c.closeErr = CloseError{Code: code, Reason: reason}
+		close(c.closed)
+		err = nil
+	})
+	return err
+}
+
+func (c *muxConn) Subprotocol() string {
+	return c.socket.conn.Subprotocol()
+}
+
+// End the subscription because the socket closed, without telling the client.
+func (c *muxConn) end(closeErr CloseError) {
+	c.closeOnce.Do(func() {
+		c.closeErr = closeErr
+		close(c.closed)
+	})
+}
+
+// Add the party's name to a JSON object.
+func tagJSON(party string, data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != '{' {
+		return nil, errors.New("Message isn't a JSON object")
+	}
+	name, err := json.Marshal(party)
+	if err != nil {
+		return nil, err
+	}
+	tagged := make([]byte, 0, len(data)+len(name)+10)
+	tagged = append(tagged, `{"party":`...)
+	tagged = append(tagged, name...)
+	if data[1] != '}' {
+		tagged = append(tagged, ',')
+	}
+	return append(tagged, data[1:]...), nil
+}
+
+// Prefix binary data with the length of the party's name, then the name.
+func tagBinary(party string, data []byte) []byte {
+	tagged := make([]byte, 0, 1+len(party)+len(data))
+	tagged = append(tagged, byte(len(party)))
+	tagged = append(tagged, party...)
+	return append(tagged, data...)
+}
+
+// Split the party's name from tagged binary data.
+func untagBinary(data []byte) (string, []byte, error) {
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return "", nil, errors.New("Binary message missing party name")
+	}
+	n := 1 + int(data[0])
+	return string(data[1:n]), data[n:], nil
+}
@@ -0,0 +1,199 @@
+package sockparty_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"golang.org/x/time/rate"
+
+	"github.com/izzymg/sockparty"
+	"github.com/izzymg/sockparty/sockpartytest"
+)
+
+// Test one connection subscribes to many parties through a mux.
+func TestMux(t *testing.T) {
+	is := is.New(t)
+
+	lobby := sockparty.New(generateUID, &sockparty.Options{})
+	lobby.Name = "lobby"
+	game := sockparty.New(generateUID, &sockparty.Options{})
+	game.Name = "game"
+	lobbyRecorder := sockpartytest.Record(lobby)
+	defer lobbyRecorder.Stop()
+	gameRecorder := sockpartytest.Record(game)
+	defer gameRecorder.Stop()
+
+	mux := sockparty.NewMux(sockpartytest.SequentialIDs("user"), &sockparty.Options{})
+	is.NoErr(mux.Add(lobby))
+	is.NoErr(mux.Add(game))
+	is.True(errors.Is(mux.Add(lobby), sockparty.ErrPartyExists))
+	long := sockparty.New(generateUID, &sockparty.Options{})
+	long.Name = strings.Repeat("a", 256)
+	is.True(errors.Is(mux.Add(long), sockparty.ErrPartyNameTooLong))
+
+	c, err := sockpartytest.Dial(mux)
+	is.NoErr(err)
+	defer c.Close()
+
+	subscribe := func(event sockparty.Event, party string) sockparty.Subscription {
+		is.NoErr(c.Send(event, sockparty.Subscription{Party: party}))
+		message, err := c.Expect(event)
+		is.NoErr(err)
+		var sub sockparty.Subscription
+		is.NoErr(message.Decode(&sub))
+		is.Equal(sub.Party, party)
+		return sub
+	}
+
+	// Joins each party with the same ID.
+	is.Equal(subscribe(sockparty.EventSubscribe, "lobby").Error, "")
+	id, err := lobbyRecorder.ExpectJoin()
+	is.NoErr(err)
+	is.Equal(id, "user1")
+	is.Equal(subscribe(sockparty.EventSubscribe, "game").Error, "")
+	id, err = gameRecorder.ExpectJoin()
+	is.NoErr(err)
+	is.Equal(id, "user1")
+
+	is.Equal(subscribe(sockparty.EventSubscribe, "game").Error, sockparty.ErrAlreadySubscribed.Error())
+	is.Equal(subscribe(sockparty.EventSubscribe, "nowhere").Error, sockparty.ErrNoSuchParty.Error())
+
+	// Messages are tagged by party in both directions.
+	is.NoErr(c.SendTo("game", "move", "up"))
+	incoming, err := gameRecorder.ExpectIncoming()
+	is.NoErr(err)
+	is.Equal(incoming.Event, sockparty.Event("move"))
+	is.Equal(string(incoming.Payload), `"up"`)
+
+	is.NoErr(lobby.Broadcast(context.Background(), &sockparty.Outgoing{Event: "chat", Payload: "hi"}))
+	message, err := c.Expect("chat")
+	is.NoErr(err)
+	is.Equal(message.Party, "lobby")
+
+	is.NoErr(c.SendBinary(append([]byte{4}, "game\x01\x02"...)))
+	binary, err := gameRecorder.ExpectBinary()
+	is.NoErr(err)
+	is.Equal(binary.Data, []byte{1, 2})
+
+	is.NoErr(game.SendBinary(context.Background(), "user1", []byte{3}))
+	message, err = c.Next()
+	is.NoErr(err)
+	is.Equal(message.Binary, append([]byte{4}, "game\x03"...))
+
+	// Unsubscribing leaves the party only.
+	is.Equal(subscribe(sockparty.EventUnsubscribe, "game").Code, sockparty.StatusNormalClosure)
+	id, err = gameRecorder.ExpectLeave()
+	is.NoErr(err)
+	is.Equal(id, "user1")
+	is.True(lobby.UserExists("user1"))
+
+	// The client is told once they've left, so they can subscribe again straight away.
+	is.Equal(subscribe(sockparty.EventSubscribe, "game").Error, "")
+	_, err = gameRecorder.ExpectJoin()
+	is.NoErr(err)
+	is.True(game.UserExists("user1"))
+
+	// Kicked users are unsubscribed with the reason.
+	is.NoErr(lobby.Kick("user1", "Bye"))
+	message, err = c.Expect(sockparty.EventUnsubscribe)
+	is.NoErr(err)
+	var sub sockparty.Subscription
+	is.NoErr(message.Decode(&sub))
+	is.Equal(sub, sockparty.Subscription{Party: "lobby", Code: sockparty.StatusPolicyViolation, Reason: "Bye"})
+	_, err = lobbyRecorder.ExpectLeave()
+	is.NoErr(err)
+}
+
+// Test users leave every party when their connection closes.
+func TestMuxClose(t *testing.T) {
+	is := is.New(t)
+
+	party := sockparty.New(generateUID, &sockparty.Options{})
+	party.Name = "party"
+	recorder := sockpartytest.Record(party)
+	defer recorder.Stop()
+	// Options default when nil.
+	mux := sockparty.NewMux(generateUID, nil)
+	is.NoErr(mux.Add(party))
+
+	c, err := sockpartytest.Dial(mux)
+	is.NoErr(err)
+	is.NoErr(c.Send(sockparty.EventSubscribe, sockparty.Subscription{Party: "party"}))
+	_, err = recorder.ExpectJoin()
+	is.NoErr(err)
+
+	is.NoErr(c.Close())
+	_, err = recorder.ExpectLeave()
+	is.NoErr(err)
+	is.Equal(party.GetConnectedUserCount(), 0)
+}
+
+// Test a party which stops reading doesn't hold up the socket's other subscriptions.
+func TestMuxStalled(t *testing.T) {
+	is := is.New(t)
+
+	// Never read from, and the user waits forever for room in their inbox.
+	slow := sockparty.New(generateUID, &sockparty.Options{})
+	slow.Name = "slow"
+	slow.SubscribeIncoming(make(chan sockparty.Incoming))
+	fast := sockparty.New(generateUID, &sockparty.Options{})
+	fast.Name = "fast"
+	recorder := sockpartytest.Record(fast)
+	defer recorder.Stop()
+	mux := sockparty.NewMux(sockpartytest.SequentialIDs("user"), &sockparty.Options{InboxSize: 2})
+	is.NoErr(mux.Add(slow))
+	is.NoErr(mux.Add(fast))
+
+	c, err := sockpartytest.Dial(mux)
+	is.NoErr(err)
+	defer c.Close()
+	for _, party := range []string{"slow", "fast"} {
+		is.NoErr(c.Send(sockparty.EventSubscribe, sockparty.Subscription{Party: party}))
+		_, err = c.Expect(sockparty.EventSubscribe)
+		is.NoErr(err)
+	}
+	_, err = recorder.ExpectJoin()
+	is.NoErr(err)
+
+	// Once its buffer is full, the client is unsubscribed from the stalled party.
+	for i := 0; i < 8; i++ {
+		is.NoErr(c.SendTo("slow", "chat", i))
+	}
+	message, err := c.Expect(sockparty.EventUnsubscribe)
+	is.NoErr(err)
+	var sub sockparty.Subscription
+	is.NoErr(message.Decode(&sub))
+	is.Equal(sub, sockparty.Subscription{Party: "slow", Code: sockparty.StatusPolicyViolation, Reason: "Too many messages."})
+	is.True(!slow.UserExists("user1"))
+
+	is.NoErr(c.SendTo("fast", "chat", "hi"))
+	incoming, err := recorder.ExpectIncoming()
+	is.NoErr(err)
+	is.Equal(string(incoming.Payload), `"hi"`)
+}
+
+// Test each socket is rate limited separately.
+func TestMuxRateLimit(t *testing.T) {
+	is := is.New(t)
+
+	party := sockparty.New(generateUID, &sockparty.Options{})
+	party.Name = "party"
+	mux := sockparty.NewMux(generateUID, &sockparty.Options{
+		RateLimiter: rate.NewLimiter(rate.Every(time.Hour), 2),
+	})
+	is.NoErr(mux.Add(party))
+
+	// Each client subscribes and closes, using up its burst without touching the other's.
+	for i := 0; i < 2; i++ {
+		c, err := sockpartytest.Dial(mux)
+		is.NoErr(err)
+		is.NoErr(c.Send(sockparty.EventSubscribe, sockparty.Subscription{Party: "party"}))
+		_, err = c.Expect(sockparty.EventSubscribe)
+		is.NoErr(err)
+		is.NoErr(c.Close())
+	}
+}
@@ -1,6 +1,7 @@
 package sockparty
 
 import (
+	"net/http"
 	"time"
 
 	"golang.org/x/time/rate"
@@ -9,24 +10,84 @@ import (
 // DefaultOptions generates party options with defaults. Use if you're just testing.
 func DefaultOptions() *Options {
 	return &Options{
-		AllowCrossOrigin: false,
-		RateLimiter:      rate.NewLimiter(rate.Every(time.Millisecond*100), 5),
-		PingFrequency:    time.Second * 15,
-		PingTimeout:      time.Second * 10,
+		RateLimiter:         rate.NewLimiter(rate.Every(time.Millisecond*100), 5),
+		PingFrequency:       time.Second * 15,
+		PingTimeout:         time.Second * 10,
+		MaxUploadSize:       8 * 1024 * 1024,
+		ChunkSize:           16 * 1024,
+		Lanes:               Lanes{High: 8, Normal: 32, Low: 8},
+		Compression:         CompressionNoContextTakeover,
+		InboxSize:           16,
+		Backpressure:        BackpressureBlock,
+		BackpressureTimeout: time.Second * 5,
+		Dispatch:            DispatchInline,
+		DispatchQueueSize:   32,
 	}
 }
 
 // Options configures a party's settings.
 type Options struct {
 
-	// Allow cross origin socket requests
+	// Deprecated: use AllowedOrigins: []string{"*"}, which this is equivalent to.
 	AllowCrossOrigin bool
+	/* Origins allowed to make cross origin socket requests, matched against the origin's host
+	and port, and scheme if given. Patterns beginning with "*." match any subdomain,
+	e.g. "*.example.com" or "https://*.example.com". A pattern of "*" allows any origin. */
+	AllowedOrigins []string
+	/* Optional, replaces origin checking. Return true if the request's origin is allowed
+	to join the party. */
+	CheckOrigin func(req *http.Request) bool
+
+	// Subprotocols supported by the party, in order of preference, e.g. "sockparty.v1+json".
+	Subprotocols []string
+	/* Optional, return false to reject users who negotiated the subprotocol. An empty subprotocol
+	means the client supports none of the party's subprotocols, or didn't request any. */
+	CheckSubprotocol func(subprotocol string) bool
+
+	/* Optional, accepts users' connections. Set to nil for WebSocket, configured by these options.
+	Compression, CompressionThreshold and ReadLimit only apply to the WebSocket transport. */
+	Transport Transport
+	/* Accept clients over Server-Sent Events, sending messages by POST, for when proxies break
+	WebSocket upgrades. Event stream clients request subprotocols with the subprotocol query parameter. */
+	AllowEventStream bool
+
+	// Determines whether messages are compressed, if the client supports it.
+	Compression CompressionMode
+	// Messages smaller than this many bytes are sent uncompressed. Set to zero for the library default.
+	CompressionThreshold int
 
 	// Limiter used against incoming client messages.
 	RateLimiter *rate.Limiter
+	// Maximum size in bytes of a single incoming message. Set to zero for the library default of 32KiB.
+	ReadLimit int64
+	// Maximum size in bytes of a user's chunked upload. Set to zero to disallow uploads.
+	MaxUploadSize int64
+	// Size in bytes of the chunks payloads are split into by Stream. Set to zero for 16KiB.
+	ChunkSize int
+	// Number of outgoing messages which may be queued per user at each priority.
+	Lanes Lanes
 
 	// Determines how frequently users are pinged. Set to zero for no pings.
 	PingFrequency time.Duration
 	// Determines how long to wait on a ping before assuming the connection is dead.
 	PingTimeout time.Duration
+	// Send users their measured latency after each ping.
+	ReportLatency bool
+	// Clock used for pings, timeouts, rate limiting and uploads, see Party.Clock. Set to nil for the real clock.
+	Clock Clock
+
+	// Number of incoming messages which may be queued per user, waiting to be received by the consumer.
+	// Messages still queued when the user leaves are discarded.
+	InboxSize int
+	// Determines what happens to incoming messages when a user's inbox is full.
+	Backpressure BackpressurePolicy
+	// Determines how long BackpressureBlock waits for room in the inbox. Set to zero to wait forever.
+	BackpressureTimeout time.Duration
+
+	// Determines how the party's Handler is called.
+	Dispatch DispatchMode
+	// Number of workers used by DispatchPool. Set to zero to use one per CPU.
+	DispatchWorkers int
+	// Number of calls which may be queued for DispatchPerUser and DispatchPool before blocking.
+	DispatchQueueSize int
 }
@@ -11,4 +11,15 @@ func TestDefaultOptions(t *testing.T) {
 	if opts.AllowCrossOrigin {
 		t.Fatal("Cross origin should be disabled by default")
 	}
+	if opts.Dispatch != sockparty.DispatchInline {
+		t.Fatal("Handlers should be called inline by default, so parties using channels don't start routines")
+	}
+}
+
+// Test parties created without options use the defaults.
+func TestNilOptions(t *testing.T) {
+	party := sockparty.New(generateUID, nil)
+	if party.Clock() == nil {
+		t.Fatal("Party should have a clock")
+	}
 }
@@ -0,0 +1,65 @@
+package sockparty
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ErrOriginNotAllowed is reported when a socket request is rejected for its origin.
+var ErrOriginNotAllowed = errors.New("Origin not allowed")
+
+/*
+Returns true if the request's origin is allowed to join the party. Requests with no origin,
+from non-browser clients, and requests from the same host are always allowed, unless
+overridden by the CheckOrigin option.
+*/
+func (opts *Options) originAllowed(req *http.Request) bool {
+	if opts.CheckOrigin != nil {
+		return opts.CheckOrigin(req)
+	}
+	if opts.AllowCrossOrigin {
+		return true
+	}
+
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, req.Host) {
+		return true
+	}
+	for _, pattern := range opts.AllowedOrigins {
+		if matchOrigin(pattern, u) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Match an origin against a pattern. A pattern of "*" matches any origin, and a pattern
+beginning with "*." matches any subdomain of the rest of the pattern. Patterns with a
+scheme, e.g. "https://example.com", only match origins with the same scheme.
+*/
+func matchOrigin(pattern string, origin *url.URL) bool {
+	if i := strings.Index(pattern, "://"); i >= 0 {
+		if !strings.EqualFold(pattern[:i], origin.Scheme) {
+			return false
+		}
+		pattern = pattern[i+len("://"):]
+	}
+	host := origin.Host
+	if pattern == "*" {
+		return true
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		return len(host) > len(pattern)-1 && strings.HasSuffix(strings.ToLower(host), strings.ToLower(pattern[1:]))
+	}
+	return strings.EqualFold(pattern, host)
+}
@@ -0,0 +1,88 @@
+package sockparty_test
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/posener/wstest"
+
+	"github.com/izzymg/sockparty"
+)
+
+// Test origins are checked against the allow-list.
+func TestAllowedOrigins(t *testing.T) {
+	var tests = map[string]struct {
+		origin  string
+		allowed bool
+	}{
+		"None":          {"", true},
+		"Same host":     {"http://localhost:3000", true},
+		"Listed":        {"https://example.com", true},
+		"Subdomain":     {"https://app.example.com", true},
+		"Deep":          {"https://a.b.example.com", true},
+		"Unlisted":      {"https://evil.com", false},
+		"Lookalike":     {"https://notexample.com", false},
+		"Other port":    {"http://localhost:4000", false},
+		"Wrong pattern": {"https://app.example.org", false},
+		"Scheme":        {"https://secure.org", true},
+		"Wrong scheme":  {"http://secure.org", false},
+		"Scheme wild":   {"https://app.secure.net", true},
+		"Insecure wild": {"http://app.secure.net", false},
+	}
+
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+
+			party := sockparty.New(generateUID, &sockparty.Options{
+				AllowedOrigins: []string{"example.com", "*.example.com", "https://secure.org", "https://*.secure.net"},
+			})
+			var reported error
+			party.ErrorHandler = func(err error) {
+				if errors.Is(err, sockparty.ErrOriginNotAllowed) {
+					reported = err
+				}
+			}
+
+			header := http.Header{}
+			if test.origin != "" {
+				header.Set("Origin", test.origin)
+			}
+			d := wstest.NewDialer(party)
+			c, resp, err := d.Dial(addr, header)
+			if test.allowed {
+				is.NoErr(err)
+				c.Close()
+				return
+			}
+			is.True(err != nil)
+			is.Equal(resp.StatusCode, http.StatusForbidden)
+			is.True(reported != nil)
+		})
+	}
+}
+
+// Test a custom origin check replaces the allow-list.
+func TestCheckOrigin(t *testing.T) {
+	is := is.New(t)
+
+	party := sockparty.New(generateUID, &sockparty.Options{
+		AllowedOrigins: []string{"*"},
+		CheckOrigin: func(req *http.Request) bool {
+			return req.Header.Get("Origin") == "https://trusted.com"
+		},
+	})
+
+	d := wstest.NewDialer(party)
+	c, _, err := d.Dial(addr, http.Header{"Origin": {"https://trusted.com"}})
+	is.NoErr(err)
+	c.Close()
+
+	d = wstest.NewDialer(party)
+	_, resp, err := d.Dial(addr, http.Header{"Origin": {"https://example.com"}})
+	is.True(err != nil)
+	is.Equal(resp.StatusCode, http.StatusForbidden)
+}
@@ -6,13 +6,18 @@ import (
 	"fmt"
 	"net/http"
 	"sync"
-
-	"nhooyr.io/websocket"
+	"time"
 )
 
 // ErrNoSuchUser is returned when an invalid user is looked up.
 var ErrNoSuchUser = errors.New("No such user found by that ID")
 
+// ErrUserExists is returned when a user joins with the ID of a user already in the party.
+var ErrUserExists = errors.New("A user with that ID already joined")
+
+// ErrUnsupportedSubprotocol is reported when a user is rejected for their subprotocol.
+var ErrUnsupportedSubprotocol = errors.New("Unsupported subprotocol")
+
 /*
 UniqueIDGenerator is a function which generates a new ID for each user join.
 Ensure it is sufficiently unique, e.g. random UUIDs or database usernames.
@@ -20,15 +25,24 @@ If an error is returned, the user will be disconnected.
 */
 type UniqueIDGenerator func() (string, error)
 
-// New creates a new room for users to join.
+// New creates a new room for users to join. Nil options use DefaultOptions.
 func New(uidGenerator UniqueIDGenerator, options *Options) *Party {
-	return &Party{
+	if options == nil {
+		options = DefaultOptions()
+	}
+	party := &Party{
 		UIDGenerator: uidGenerator,
 		ErrorHandler: func(e error) {},
 
 		opts:           options,
-		connectedUsers: make(map[string]*user),
+		created:        options.clock().Now(),
+		connectedUsers: make(map[string]*User),
+		permissions:    make(map[Event][]Role),
 	}
+	party.subs = newSubscriptions()
+	party.state = newState(party)
+	party.dispatcher = newDispatcher(options)
+	return party
 }
 
 // Party represents a group of users connected in a socket session.
@@ -36,62 +50,156 @@ type Party struct {
 	// Human readable name of the party
 	Name         string
 	UIDGenerator UniqueIDGenerator
+	// Optional, assigns users their roles on join.
+	RoleAssigner RoleAssigner
 
 	// Called when an error occurs within the party.
 	ErrorHandler func(err error)
 
-	userJoinChannel  chan string
-	userLeaveChannel chan string
-	incoming         chan Incoming
-
 	opts           *Options
-	connectedUsers map[string]*user
+	subs           *subscriptions
+	state          *State
+	handler        Handler
+	dispatcher     *dispatcher
+	connectedUsers map[string]*User
+	permissions    map[Event][]Role
+	sessions       sync.Map
+	created        time.Time
+	dropped        uint64
+	received       uint64
+	sent           uint64
 	mut            sync.RWMutex
 }
 
 /*
 ServeHTTP handles an HTTP request to join the room and upgrade to WebSocket.
-It blocks until the user leaves/disconnects.
+It blocks until the user leaves/disconnects. If the AllowEventStream option is set,
+clients may join over Server-Sent Events instead.
 */
 func (party *Party) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 
-	// Upgrade the HTTP request to a socket connection
-	conn, err := websocket.Accept(rw, req, &websocket.AcceptOptions{
-		InsecureSkipVerify: party.opts.AllowCrossOrigin,
-	})
+	// Origin is verified here, rather than by the upgrade, to allow patterns.
+	if !party.opts.originAllowed(req) {
+		party.reportError(fmt.Errorf("%w: %q", ErrOriginNotAllowed, req.Header.Get("Origin")))
+		http.Error(rw, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+	if party.opts.AllowEventStream && isEventStream(req) {
+		party.serveEventStream(rw, req)
+		return
+	}
+
+	// Upgrade the HTTP request to a socket connection.
+	conn, err := party.opts.transport().Accept(rw, req)
 	if err != nil {
-		party.ErrorHandler(fmt.Errorf("failed to upgrade websocket connection: %v", err))
+		party.reportError(fmt.Errorf("failed to upgrade websocket connection: %v", err))
 		return
 	}
+	party.serveConn(req, conn)
+}
 
-	/* Party's incoming channel is passed to new users, so all incoming data
-	is funnelled back to the consumer. */
+// Join the user connected by the request to the party, over any transport. Blocks until the user leaves.
+func (party *Party) serveConn(req *http.Request, conn Conn) {
+	if !party.subprotocolAllowed(conn) {
+		return
+	}
 	uid, err := party.UIDGenerator()
 	if err != nil {
-		party.ErrorHandler(fmt.Errorf("failed to generate unique ID: %v", err))
-		conn.Close(websocket.StatusInternalError, "User creation failed")
+		party.reportError(fmt.Errorf("failed to generate unique ID: %v", err))
+		conn.Close(StatusInternalError, "User creation failed")
 		return
 	}
+	info := UserInfo{ID: uid}
+	if party.RoleAssigner != nil {
+		info.Roles, err = party.RoleAssigner(req, uid)
+		if err != nil {
+			party.reportError(fmt.Errorf("failed to assign roles: %v", err))
+			conn.Close(StatusInternalError, "User creation failed")
+			return
+		}
+	}
+	party.join(req.Context(), conn, info)
+}
+
+// UserInfo describes a user joining a party with Join.
+type UserInfo struct {
+	// Optional, generated by the party's UIDGenerator if empty.
+	ID    string
+	Name  string
+	Roles []Role
+}
+
+/*
+Join adds a user to the party over a connection the application already accepted, such as
+a WebSocket wrapped with WebSocketConn, for applications which upgrade requests themselves.
+The user is handled exactly as if they'd joined with ServeHTTP, except the RoleAssigner,
+as their roles are given. Blocks until the user leaves or the context is canceled,
+returning the error which ended the connection, which is also reported to the ErrorHandler.
+*/
+func (party *Party) Join(ctx context.Context, conn Conn, info UserInfo) error {
+	if !party.subprotocolAllowed(conn) {
+		return ErrUnsupportedSubprotocol
+	}
+	if info.ID == "" {
+		uid, err := party.UIDGenerator()
+		if err != nil {
+			conn.Close(StatusInternalError, "User creation failed")
+			return fmt.Errorf("failed to generate unique ID: %w", err)
+		}
+		info.ID = uid
+	}
+	return party.join(ctx, conn, info)
+}
+
+// Close connections with subprotocols the party doesn't allow, returning false.
+func (party *Party) subprotocolAllowed(conn Conn) bool {
+	if party.opts.CheckSubprotocol != nil && !party.opts.CheckSubprotocol(conn.Subprotocol()) {
+		party.reportError(fmt.Errorf("%w: %q", ErrUnsupportedSubprotocol, conn.Subprotocol()))
+		conn.Close(StatusPolicyViolation, "Unsupported subprotocol")
+		return false
+	}
+	return true
+}
+
+// Add the user to the party and process their connection, blocking until they leave.
+func (party *Party) join(ctx context.Context, conn Conn, info UserInfo) error {
 	usr := newUser(
-		uid,
-		party.incoming,
+		info.ID,
+		party,
 		conn,
 		party.opts,
 	)
+	usr.Name = info.Name
+	usr.setRoles(info.Roles)
+	_, usr.muxed = conn.(*muxConn)
+
+	// Start writing to the user, until they've left.
+	writing, stopWriting := context.WithCancel(ctx)
+	defer stopWriting()
+	go usr.writeLoop(writing)
 
 	// Add the user and begin processing
-	party.addUser(usr)
+	err := party.addUser(ctx, usr)
+	if err != nil {
+		conn.Close(StatusPolicyViolation, "Already joined")
+		return err
+	}
 	closed := make(chan error)
-	go usr.listen(req.Context(), closed)
+	go usr.listen(ctx, closed)
 	for {
 		select {
 		case err := <-closed:
 			// User listen closed
 			if err != nil {
-				go party.ErrorHandler(err)
+				go party.reportError(err)
 			}
-			party.removeUser(usr.ID)
-			return
+			// Wait for delivery to stop before the user leaves whichever party they were
+			// transferred to, so leave comes after their last message. Undelivered messages are discarded.
+			<-usr.drained
+			current := usr.currentParty()
+			current.removeUser(usr)
+			current.dispatcher.stop(usr)
+			return err
 		}
 	}
 }
@@ -104,6 +212,17 @@ func (party *Party) UserExists(userID string) bool {
 	return ok
 }
 
+// Copy the party's users, so they can be written to without holding the lock.
+func (party *Party) users() []*User {
+	party.mut.RLock()
+	defer party.mut.RUnlock()
+	users := make([]*User, 0, len(party.connectedUsers))
+	for _, usr := range party.connectedUsers {
+		users = append(users, usr)
+	}
+	return users
+}
+
 /*
 GetConnectedUserIDs returns a list of all currently connected user's IDs,
 this is O(n). */
@@ -120,6 +239,21 @@ func (party *Party) GetConnectedUserIDs() []string {
 	return userIDs
 }
 
+// State returns the party's shared state, which is replicated to all users.
+func (party *Party) State() *State {
+	return party.state
+}
+
+// GetUser returns a handle to a connected user by their ID.
+func (party *Party) GetUser(userID string) (*User, error) {
+	party.mut.RLock()
+	defer party.mut.RUnlock()
+	if usr, ok := party.connectedUsers[userID]; ok {
+		return usr, nil
+	}
+	return nil, ErrNoSuchUser
+}
+
 // GetConnectedUserCount returns the number of currently connected users.
 func (party *Party) GetConnectedUserCount() int {
 	party.mut.RLock()
@@ -127,12 +261,24 @@ func (party *Party) GetConnectedUserCount() int {
 	return len(party.connectedUsers)
 }
 
-// Broadcast writes a single outgoing message to all users currently active in the party.
+/*
+Broadcast writes a single outgoing message to all users currently active in the party.
+The message is encoded once for all users.
+*/
 func (party *Party) Broadcast(ctx context.Context, message *Outgoing) error {
+	prepared, err := NewPreparedMessage(message)
+	if err != nil {
+		return err
+	}
+	return party.BroadcastPrepared(ctx, prepared)
+}
+
+// BroadcastPrepared writes a prepared message to all users currently active in the party.
+func (party *Party) BroadcastPrepared(ctx context.Context, message *PreparedMessage) error {
 	party.mut.RLock()
 	defer party.mut.RUnlock()
 	for _, usr := range party.connectedUsers {
-		usr.write(ctx, message)
+		usr.writePrepared(ctx, message)
 	}
 	return nil
 }
@@ -147,73 +293,116 @@ func (party *Party) Message(ctx context.Context, userID string, message *Outgoin
 	return ErrNoSuchUser
 }
 
+// MessagePrepared writes a prepared message to a user by their ID.
+func (party *Party) MessagePrepared(ctx context.Context, userID string, message *PreparedMessage) error {
+	party.mut.RLock()
+	defer party.mut.RUnlock()
+	if usr, ok := party.connectedUsers[userID]; ok {
+		return usr.writePrepared(ctx, message)
+	}
+	return ErrNoSuchUser
+}
+
 /*
-End attempts to remove all users from the party, closing the underlying socket connections
-with a message.
+End removes all users from the party, closing the underlying socket connections
+with a message. Leave is fired for each user once their queued messages are delivered.
 */
 func (party *Party) End(message string) {
 	party.mut.Lock()
-	defer party.mut.Unlock()
+	users := make([]*User, 0, len(party.connectedUsers))
 	for _, user := range party.connectedUsers {
-		user.close(message)
+		users = append(users, user)
 		delete(party.connectedUsers, user.ID)
 	}
+	party.mut.Unlock()
+	for _, user := range users {
+		user.close(message)
+	}
+}
+
+/*
+Kick disconnects a user by their ID, sending them the reason, which may be up to MaxCloseReason bytes.
+They leave the party as usual.
+*/
+func (party *Party) Kick(userID string, reason string) error {
+	if len(reason) > MaxCloseReason {
+		return ErrReasonTooLong
+	}
+	usr, err := party.GetUser(userID)
+	if err != nil {
+		return err
+	}
+	return usr.kick(reason)
 }
 
 /*
 RegisterIncoming registers the channel to be used for all incoming user messages,
 replacing the previous if any; this is a fan-in style API, if there is no receiver,
-the party will block.
+the party will block. It is safe to call at any time, and applies to all users.
+Pass nil to remove the registered channel.
 */
 func (party *Party) RegisterIncoming(ch chan Incoming) {
-	party.incoming = ch
+	party.subs.setIncoming(registeredID, ch)
 }
 
 /*
 RegisterOnUserJoined registers the channel to be used for sending user information
 when a user has joined, replacing the previous if any; if registered, the consumer
 must listen on it to avoid blocking the party. When this is sent into, the user has
-already joined the party, and is valid to message.
+already joined the party, and is valid to message. It is safe to call at any time.
 */
 func (party *Party) RegisterOnUserJoined(ch chan string) {
-	party.userJoinChannel = ch
+	party.subs.setUserChannel(party.subs.joined, registeredID, ch)
 }
 
 /*
 RegisterOnUserLeft registers the channel to be used for sending user information
 when a user has left the party, replacing the previous if any; if registered, the consumer
 must listen on it to avoid blocking the party. When this is sent into, the user has already
-left the party, and is no longer valid to message.
+left the party, and is no longer valid to message. It is safe to call at any time.
 */
 func (party *Party) RegisterOnUserLeft(ch chan string) {
-	party.userLeaveChannel = ch
+	party.subs.setUserChannel(party.subs.left, registeredID, ch)
 }
 
 /* Write locks should be released before callbacks,
 to prevent deadlocking if callback attempts to read or write. */
 
-// Remove the user from the party's list, and run callbacks.
-func (party *Party) removeUser(id string) error {
+// Remove the user from the party's list, if End hasn't already, and run callbacks.
+// Leaves are published even once the user's context is canceled, so they aren't lost.
+func (party *Party) removeUser(usr *User) {
 	party.mut.Lock()
-	if user, ok := party.connectedUsers[id]; ok {
-		delete(party.connectedUsers, user.ID)
-		party.mut.Unlock()
-		if party.userLeaveChannel != nil {
-			party.userLeaveChannel <- id
-		}
-		return nil
+	// The user may already be gone, and their ID taken by someone who joined since.
+	if party.connectedUsers[usr.ID] == usr {
+		delete(party.connectedUsers, usr.ID)
 	}
 	party.mut.Unlock()
-	return ErrNoSuchUser
+	party.subs.publishUser(context.Background(), party.subs.left, usr.ID)
+	party.dispatch(usr, func(handler Handler) {
+		handler.OnLeave(usr.ID)
+	})
 }
 
-// Add a user to the party's list, and run callbacks.
-func (party *Party) addUser(usr *user) {
+// Add a user to the party's list, and run callbacks. Fails if a user with the same ID is in the party.
+// The user is sent the current state before any state patches can be broadcast to them.
+func (party *Party) addUser(ctx context.Context, usr *User) error {
+	party.dispatcher.start(usr)
 	party.mut.Lock()
+	if _, ok := party.connectedUsers[usr.ID]; ok {
+		party.mut.Unlock()
+		party.dispatcher.stop(usr)
+		return fmt.Errorf("%w: %q", ErrUserExists, usr.ID)
+	}
 	party.connectedUsers[usr.ID] = usr
 	party.mut.Unlock()
-
-	if party.userJoinChannel != nil {
-		party.userJoinChannel <- usr.ID
+	err := usr.syncState(ctx)
+	if err != nil {
+		go party.reportError(fmt.Errorf("failed to send state snapshot: %v", err))
 	}
+
+	party.subs.publishUser(ctx, party.subs.joined, usr.ID)
+	party.dispatch(usr, func(handler Handler) {
+		handler.OnJoin(usr.ID)
+	})
+	return nil
 }
@@ -350,3 +350,390 @@ func TestGetUserIDs(t *testing.T) {
 		}
 	}
 }
+
+// Test users are pinged, have their latency measured, and are sent it if enabled.
+func TestLatency(t *testing.T) {
+	is := is.New(t)
+
+	party := sockparty.New(generateUID, &sockparty.Options{
+		PingFrequency: time.Millisecond * 20,
+		PingTimeout:   time.Second,
+		ReportLatency: true,
+	})
+	userJoined := make(chan string)
+	party.RegisterOnUserJoined(userJoined)
+
+	d := wstest.NewDialer(party)
+	c, _, err := d.Dial(addr, nil)
+	is.NoErr(err)
+	defer c.Close()
+
+	id := <-userJoined
+
+	// Reading handles the pings, and the latency report follows a successful ping.
+	var report struct {
+		Event   string `json:"event"`
+		Payload struct {
+			Samples int `json:"samples"`
+		} `json:"payload"`
+	}
+	err = c.ReadJSON(&report)
+	is.NoErr(err)
+	is.Equal(report.Event, string(sockparty.EventLatency))
+	is.True(report.Payload.Samples > 0)
+
+	usr, err := party.GetUser(id)
+	is.NoErr(err)
+	is.True(usr.Latency().Samples > 0)
+
+	_, err = party.GetUser("idontexist")
+	is.Equal(err, sockparty.ErrNoSuchUser)
+}
+
+// Test registering after users join, and subscribing multiple channels.
+func TestSubscribe(t *testing.T) {
+	is := is.New(t)
+
+	party := sockparty.New(generateUID, &sockparty.Options{
+		PingFrequency: 0,
+	})
+	userJoined := make(chan string)
+	party.RegisterOnUserJoined(userJoined)
+
+	d := wstest.NewDialer(party)
+	c, _, err := d.Dial(addr, nil)
+	is.NoErr(err)
+	defer c.Close()
+	<-userJoined
+
+	// Registered after joining, and alongside a subscriber.
+	registered := make(chan sockparty.Incoming, 1)
+	subscribed := make(chan sockparty.Incoming, 1)
+	party.RegisterIncoming(registered)
+	unsubscribe := party.SubscribeIncoming(subscribed)
+
+	is.NoErr(c.WriteJSON(&sockparty.Outgoing{Event: "first"}))
+	is.Equal((<-registered).Event, sockparty.Event("first"))
+	is.Equal((<-subscribed).Event, sockparty.Event("first"))
+
+	// Unsubscribed channels receive nothing more.
+	unsubscribe()
+	unsubscribe()
+	is.NoErr(c.WriteJSON(&sockparty.Outgoing{Event: "second"}))
+	is.Equal((<-registered).Event, sockparty.Event("second"))
+	select {
+	case <-subscribed:
+		t.Fatal("Unsubscribed channel received a message")
+	default:
+	}
+}
+
+// Test unsubscribing unblocks the party, even while it's sending to the channel.
+func TestUnsubscribeBlocked(t *testing.T) {
+	is := is.New(t)
+
+	party := sockparty.New(generateUID, &sockparty.Options{
+		PingFrequency: 0,
+	})
+	// Never received from.
+	unsubscribe := party.SubscribeOnUserJoined(make(chan string))
+	userLeft := make(chan string)
+	party.RegisterOnUserLeft(userLeft)
+
+	c, _, err := wstest.NewDialer(party).Dial(addr, nil)
+	is.NoErr(err)
+	time.Sleep(time.Millisecond * 50)
+	unsubscribe()
+
+	// The join completes, so the user can leave.
+	c.Close()
+	select {
+	case <-userLeft:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Timed out waiting for the user to leave")
+	}
+}
+
+// Test subprotocols are negotiated, and clients without a supported one can be rejected.
+func TestSubprotocols(t *testing.T) {
+	is := is.New(t)
+
+	party := sockparty.New(generateUID, &sockparty.Options{
+		PingFrequency: 0,
+		Subprotocols:  []string{"sockparty.v2+msgpack", "sockparty.v1+json"},
+		CheckSubprotocol: func(subprotocol string) bool {
+			return subprotocol != ""
+		},
+	})
+	userJoined := make(chan string)
+	party.RegisterOnUserJoined(userJoined)
+
+	d := wstest.NewDialer(party)
+	d.Subprotocols = []string{"sockparty.v1+json"}
+	c, resp, err := d.Dial(addr, nil)
+	is.NoErr(err)
+	defer c.Close()
+	is.Equal(resp.Header.Get("Sec-WebSocket-Protocol"), "sockparty.v1+json")
+
+	usr, err := party.GetUser(<-userJoined)
+	is.NoErr(err)
+	is.Equal(usr.Subprotocol(), "sockparty.v1+json")
+
+	// Old clients speaking no subprotocol are closed.
+	d = wstest.NewDialer(party)
+	old, _, err := d.Dial(addr, nil)
+	is.NoErr(err)
+	defer old.Close()
+	_, _, err = old.ReadMessage()
+	is.True(websocket.IsCloseError(err, websocket.ClosePolicyViolation))
+}
+
+// Test large repetitive messages are compressed when enabled.
+func TestCompression(t *testing.T) {
+	modes := map[string]struct {
+		mode       sockparty.CompressionMode
+		compressed bool
+	}{
+		"Disabled":          {sockparty.CompressionDisabled, false},
+		"ContextTakeover":   {sockparty.CompressionContextTakeover, true},
+		"NoContextTakeover": {sockparty.CompressionNoContextTakeover, true},
+	}
+
+	for name, test := range modes {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+
+			party := sockparty.New(generateUID, &sockparty.Options{
+				PingFrequency: 0,
+				Compression:   test.mode,
+			})
+			userJoined := make(chan string)
+			party.RegisterOnUserJoined(userJoined)
+
+			d := wstest.NewDialer(party)
+			d.EnableCompression = true
+			c, _, err := d.Dial(addr, nil)
+			is.NoErr(err)
+			defer c.Close()
+			id := <-userJoined
+
+			playlist := make([]string, 200)
+			for i := range playlist {
+				playlist[i] = "https://example.com/videos/video.mp4"
+			}
+			go c.ReadMessage()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+			is.NoErr(party.Message(ctx, id, &sockparty.Outgoing{
+				Event:   "playlist",
+				Payload: playlist,
+			}))
+
+			usr, err := party.GetUser(id)
+			is.NoErr(err)
+			compression := usr.Compression()
+			is.True(compression.MessageBytes > 0)
+			is.Equal(compression.Ratio() < 0.5, test.compressed)
+		})
+	}
+}
+
+// Test prepared messages can be broadcast and messaged repeatedly.
+func TestPreparedMessage(t *testing.T) {
+	is := is.New(t)
+
+	party := sockparty.New(generateUID, &sockparty.Options{
+		PingFrequency: 0,
+	})
+	userJoined := make(chan string)
+	party.RegisterOnUserJoined(userJoined)
+
+	d := wstest.NewDialer(party)
+	c, _, err := d.Dial(addr, nil)
+	is.NoErr(err)
+	defer c.Close()
+	id := <-userJoined
+
+	prepared, err := sockparty.NewPreparedMessage(&sockparty.Outgoing{
+		Event:   "prepared",
+		Payload: "Hello",
+	})
+	is.NoErr(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	go func() {
+		party.BroadcastPrepared(ctx, prepared)
+		party.MessagePrepared(ctx, id, prepared)
+	}()
+	for i := 0; i < 2; i++ {
+		var received struct {
+			Event   string `json:"event"`
+			Payload string `json:"payload"`
+		}
+		is.NoErr(c.ReadJSON(&received))
+		is.Equal(received.Event, "prepared")
+		is.Equal(received.Payload, "Hello")
+	}
+	is.Equal(party.MessagePrepared(ctx, "idontexist", prepared), sockparty.ErrNoSuchUser)
+
+	_, err = sockparty.NewPreparedMessage(&sockparty.Outgoing{Payload: make(chan int)})
+	is.True(err != nil)
+}
+
+/*
+Dial n connections to a party for benchmarking, discarding everything they read.
+Returns the connected user's IDs.
+*/
+func dialBench(b *testing.B, n int, party *sockparty.Party) ([]string, func()) {
+	userJoined := make(chan string, n)
+	unsubscribe := party.SubscribeOnUserJoined(userJoined)
+	defer unsubscribe()
+
+	conns := make([]*websocket.Conn, n)
+	ids := make([]string, n)
+	for i := 0; i < n; i++ {
+		d := wstest.NewDialer(party)
+		c, _, err := d.Dial(addr, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		go func() {
+			for {
+				if _, _, err := c.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+		conns[i] = c
+		ids[i] = <-userJoined
+	}
+	return ids, func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}
+}
+
+// A playlist-like payload for benchmarking.
+func benchPayload() interface{} {
+	playlist := make([]map[string]interface{}, 50)
+	for i := range playlist {
+		playlist[i] = map[string]interface{}{
+			"id":       i,
+			"url":      fmt.Sprintf("https://example.com/videos/%d.mp4", i),
+			"title":    "Video title",
+			"duration": 300.5,
+		}
+	}
+	return playlist
+}
+
+// Broadcast to 1k users, encoding the message once.
+func BenchmarkBroadcast1k(b *testing.B) {
+	party := sockparty.New(generateUID, &sockparty.Options{PingFrequency: 0})
+	_, cleanup := dialBench(b, 1000, party)
+	defer cleanup()
+	message := &sockparty.Outgoing{Event: "playlist", Payload: benchPayload()}
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		party.Broadcast(ctx, message)
+	}
+}
+
+// Message 1k users individually, encoding the message for every user, for comparison with Broadcast.
+func BenchmarkMessageEach1k(b *testing.B) {
+	party := sockparty.New(generateUID, &sockparty.Options{PingFrequency: 0})
+	ids, cleanup := dialBench(b, 1000, party)
+	defer cleanup()
+	message := &sockparty.Outgoing{Event: "playlist", Payload: benchPayload()}
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, id := range ids {
+			party.Message(ctx, id, message)
+		}
+	}
+}
+
+// Test queued messages are written to a user in priority order.
+func TestPriority(t *testing.T) {
+	is := is.New(t)
+
+	party := sockparty.New(generateUID, &sockparty.Options{
+		PingFrequency: 0,
+		Lanes:         sockparty.Lanes{High: 2, Normal: 2, Low: 2},
+	})
+	userJoined := make(chan string)
+	party.RegisterOnUserJoined(userJoined)
+
+	d := wstest.NewDialer(party)
+	c, _, err := d.Dial(addr, nil)
+	is.NoErr(err)
+	defer c.Close()
+	id := <-userJoined
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	send := func(event sockparty.Event, priority sockparty.Priority) {
+		go party.Message(ctx, id, &sockparty.Outgoing{Event: event, Priority: priority})
+	}
+
+	// The first message blocks the writer, as the client isn't reading yet.
+	send("first", sockparty.PriorityLow)
+	time.Sleep(time.Millisecond * 100)
+	send("low", sockparty.PriorityLow)
+	send("normal", sockparty.PriorityNormal)
+	send("high", sockparty.PriorityHigh)
+	time.Sleep(time.Millisecond * 100)
+
+	for _, expected := range []string{"first", "high", "normal", "low"} {
+		var message struct {
+			Event string `json:"event"`
+		}
+		is.NoErr(c.ReadJSON(&message))
+		is.Equal(message.Event, expected)
+	}
+}
+
+// Test writers give up at their deadline while queued behind a stalled write, and their message is skipped.
+func TestWriteDeadline(t *testing.T) {
+	is := is.New(t)
+
+	party := sockparty.New(generateUID, &sockparty.Options{
+		PingFrequency: 0,
+		Lanes:         sockparty.Lanes{High: 2, Normal: 2, Low: 2},
+	})
+	userJoined := make(chan string)
+	party.RegisterOnUserJoined(userJoined)
+
+	d := wstest.NewDialer(party)
+	c, _, err := d.Dial(addr, nil)
+	is.NoErr(err)
+	defer c.Close()
+	id := <-userJoined
+
+	// The first message blocks the writer, as the client isn't reading yet.
+	go party.Message(context.Background(), id, &sockparty.Outgoing{Event: "first"})
+	time.Sleep(time.Millisecond * 100)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	err = party.Message(ctx, id, &sockparty.Outgoing{Event: "expired"})
+	is.Equal(err, context.DeadlineExceeded)
+	go party.Message(context.Background(), id, &sockparty.Outgoing{Event: "last"})
+	time.Sleep(time.Millisecond * 100)
+
+	for _, expected := range []string{"first", "last"} {
+		var message struct {
+			Event string `json:"event"`
+		}
+		is.NoErr(c.ReadJSON(&message))
+		is.Equal(message.Event, expected)
+	}
+}
@@ -0,0 +1,121 @@
+package sockparty
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// ErrUserLeft is returned when writing to a user who left before the message could be written.
+var ErrUserLeft = errors.New("User left before the message was written")
+
+// Priority determines the order outgoing messages queued for a user are written in.
+type Priority int
+
+const (
+	// PriorityLow messages are written after all others, used for bulk data such as streams.
+	PriorityLow Priority = -1
+	// PriorityNormal is the default priority.
+	PriorityNormal Priority = 0
+	// PriorityHigh messages are written before all others, used for control messages.
+	PriorityHigh Priority = 1
+)
+
+// Lanes configures how many outgoing messages may be queued per user at each priority.
+type Lanes struct {
+	High   int
+	Normal int
+	Low    int
+}
+
+// frame is an outgoing message queued to be written to a user.
+type frame struct {
+	ctx    context.Context
+	typ    MessageType
+	data   []byte
+	result chan error
+}
+
+/* Each user has a lane per priority, and a single writer routine which always takes from
+the highest priority lane with a message waiting. Writers wait for their message to be
+written, so errors are returned as if writing directly. */
+
+// Queue a message in the lane for its priority, and wait for it to be written.
+func (usr *User) send(ctx context.Context, priority Priority, typ MessageType, data []byte) error {
+	lane := usr.normal
+	switch {
+	case priority > PriorityNormal:
+		lane = usr.high
+	case priority < PriorityNormal:
+		lane = usr.low
+	}
+
+	f := &frame{
+		ctx:    ctx,
+		typ:    typ,
+		data:   data,
+		result: make(chan error, 1),
+	}
+	select {
+	case lane <- f:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-usr.stopped:
+		return ErrUserLeft
+	}
+	select {
+	case err := <-f.result:
+		return err
+	case <-ctx.Done():
+		// The writer skips the frame once it gets to it.
+		return ctx.Err()
+	case <-usr.stopped:
+		return ErrUserLeft
+	}
+}
+
+// Write queued messages to the connection in priority order, until the context is canceled.
+func (usr *User) writeLoop(ctx context.Context) {
+	defer close(usr.stopped)
+	for {
+		var f *frame
+		select {
+		case f = <-usr.high:
+		default:
+			select {
+			case f = <-usr.normal:
+			default:
+				select {
+				case f = <-usr.low:
+				default:
+					// Nothing waiting, take whatever comes first.
+					select {
+					case f = <-usr.high:
+					case f = <-usr.normal:
+					case f = <-usr.low:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}
+		// Skip frames whose writer gave up waiting.
+		if err := f.ctx.Err(); err != nil {
+			f.result <- err
+			continue
+		}
+		f.result <- usr.writeFrame(f)
+	}
+}
+
+// Write a single frame to the connection.
+func (usr *User) writeFrame(f *frame) error {
+	err := usr.connection.WriteMessage(f.ctx, f.typ, f.data)
+	if err != nil {
+		return fmt.Errorf("Write to user failed: %w", err)
+	}
+	atomic.AddUint64(&usr.messageBytes, uint64(len(f.data)))
+	atomic.AddUint64(&usr.currentParty().sent, 1)
+	return nil
+}
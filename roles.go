@@ -0,0 +1,90 @@
+package sockparty
+
+import (
+	"net/http"
+)
+
+// Role is a named set of permissions a user may hold, e.g. "moderator".
+type Role string
+
+/*
+RoleAssigner is a function which determines the roles of a user as they join,
+e.g. from the request's session cookie. If an error is returned, the user will be disconnected.
+*/
+type RoleAssigner func(req *http.Request, userID string) ([]Role, error)
+
+// Forbidden is the payload of an EventForbidden message.
+type Forbidden struct {
+	// The event the user was not permitted to send.
+	Event Event `json:"event"`
+}
+
+// Roles returns the user's roles.
+func (usr *User) Roles() []Role {
+	usr.mut.RLock()
+	defer usr.mut.RUnlock()
+	roles := make([]Role, 0, len(usr.roles))
+	for role := range usr.roles {
+		roles = append(roles, role)
+	}
+	return roles
+}
+
+// HasRole returns true if the user holds the role.
+func (usr *User) HasRole(role Role) bool {
+	usr.mut.RLock()
+	defer usr.mut.RUnlock()
+	return usr.roles[role]
+}
+
+// Replace the user's roles.
+func (usr *User) setRoles(roles []Role) {
+	set := make(map[Role]bool, len(roles))
+	for _, role := range roles {
+		set[role] = true
+	}
+	usr.mut.Lock()
+	defer usr.mut.Unlock()
+	usr.roles = set
+}
+
+// SetUserRoles replaces the roles of a connected user by their ID.
+func (party *Party) SetUserRoles(userID string, roles ...Role) error {
+	usr, err := party.GetUser(userID)
+	if err != nil {
+		return err
+	}
+	usr.setRoles(roles)
+	return nil
+}
+
+/*
+RequireRoles restricts an event to users holding any of the given roles, replacing
+the previous restriction if any. Messages from users without permission are not delivered,
+and the user is sent an EventForbidden message instead. Pass no roles to lift the restriction.
+*/
+func (party *Party) RequireRoles(event Event, roles ...Role) {
+	party.mut.Lock()
+	defer party.mut.Unlock()
+	if len(roles) == 0 {
+		delete(party.permissions, event)
+		return
+	}
+	party.permissions[event] = roles
+}
+
+// Returns true if the user is permitted to send the event.
+func (party *Party) permitted(usr *User, event Event) bool {
+	party.mut.RLock()
+	roles, ok := party.permissions[event]
+	party.mut.RUnlock()
+	if !ok {
+		return true
+	}
+	for _, role := range roles {
+		if usr.HasRole(role) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package sockparty_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/posener/wstest"
+
+	"github.com/izzymg/sockparty"
+)
+
+// Test events requiring a role are only delivered from users holding it.
+func TestRequireRoles(t *testing.T) {
+	is := is.New(t)
+
+	party := sockparty.New(generateUID, &sockparty.Options{
+		PingFrequency: 0,
+	})
+	party.RoleAssigner = func(req *http.Request, userID string) ([]sockparty.Role, error) {
+		if req.Header.Get("X-Role") == "moderator" {
+			return []sockparty.Role{"moderator"}, nil
+		}
+		return nil, nil
+	}
+	party.RequireRoles("kick", "moderator")
+
+	incoming := make(chan sockparty.Incoming)
+	userJoined := make(chan string)
+	party.RegisterIncoming(incoming)
+	party.RegisterOnUserJoined(userJoined)
+
+	d := wstest.NewDialer(party)
+	moderator, _, err := d.Dial(addr, http.Header{"X-Role": {"moderator"}})
+	is.NoErr(err)
+	defer moderator.Close()
+	moderatorID := <-userJoined
+
+	d = wstest.NewDialer(party)
+	guest, _, err := d.Dial(addr, nil)
+	is.NoErr(err)
+	defer guest.Close()
+	guestID := <-userJoined
+
+	usr, err := party.GetUser(moderatorID)
+	is.NoErr(err)
+	is.True(usr.HasRole("moderator"))
+
+	// Moderators can kick.
+	is.NoErr(moderator.WriteJSON(&sockparty.Outgoing{Event: "kick"}))
+	message := <-incoming
+	is.Equal(message.UserID, moderatorID)
+
+	// Guests are told they can't.
+	is.NoErr(guest.WriteJSON(&sockparty.Outgoing{Event: "kick"}))
+	var reply struct {
+		Event   sockparty.Event     `json:"event"`
+		Payload sockparty.Forbidden `json:"payload"`
+	}
+	is.NoErr(guest.ReadJSON(&reply))
+	is.Equal(reply.Event, sockparty.EventForbidden)
+	is.Equal(reply.Payload.Event, sockparty.Event("kick"))
+
+	// Other events are unrestricted.
+	is.NoErr(guest.WriteJSON(&sockparty.Outgoing{Event: "chat_message"}))
+	message = <-incoming
+	is.Equal(message.UserID, guestID)
+
+	// Roles can be granted later.
+	is.NoErr(party.SetUserRoles(guestID, "moderator"))
+	is.NoErr(guest.WriteJSON(&sockparty.Outgoing{Event: "kick"}))
+	message = <-incoming
+	is.Equal(message.UserID, guestID)
+	is.Equal(party.SetUserRoles("idontexist"), sockparty.ErrNoSuchUser)
+}
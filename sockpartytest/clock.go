@@ -0,0 +1,141 @@
+package sockpartytest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/izzymg/sockparty"
+)
+
+/*
+FakeClock is a clock whose time only moves when advanced, for testing pings, timeouts
+and rate limits without waiting. Set it as a party's Clock option.
+*/
+type FakeClock struct {
+	mut    sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+	// Closed and replaced whenever a timer is added.
+	added chan struct{}
+}
+
+// NewFakeClock creates a fake clock starting at the time.
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{
+		now:   start,
+		added: make(chan struct{}),
+	}
+}
+
+// Now returns the clock's current time.
+func (c *FakeClock) Now() time.Time {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.now
+}
+
+// NewTimer creates a timer which fires once the clock is advanced past the duration.
+func (c *FakeClock) NewTimer(d time.Duration) sockparty.Timer {
+	return c.add(d, 0)
+}
+
+// NewTicker creates a ticker which ticks each time the clock is advanced past a period.
+func (c *FakeClock) NewTicker(d time.Duration) sockparty.Ticker {
+	return fakeTicker{c.add(d, d)}
+}
+
+/*
+Advance moves the clock forward, firing any timers and tickers due.
+Like real tickers, a ticker advanced past several periods ticks once.
+*/
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.now = c.now.Add(d)
+	active := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			active = append(active, t)
+			continue
+		}
+		select {
+		case t.c <- c.now:
+		default:
+		}
+		if t.period > 0 {
+			for !t.at.After(c.now) {
+				t.at = t.at.Add(t.period)
+			}
+			active = append(active, t)
+		}
+	}
+	c.timers = active
+}
+
+/*
+BlockUntil blocks until at least n timers and tickers are waiting on the clock,
+so a test can advance the clock once a party has started waiting.
+*/
+func (c *FakeClock) BlockUntil(n int) {
+	for {
+		c.mut.Lock()
+		waiting := len(c.timers)
+		added := c.added
+		c.mut.Unlock()
+		if waiting >= n {
+			return
+		}
+		<-added
+	}
+}
+
+func (c *FakeClock) add(d time.Duration, period time.Duration) *fakeTimer {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	t := &fakeTimer{
+		clock:  c,
+		c:      make(chan time.Time, 1),
+		at:     c.now.Add(d),
+		period: period,
+	}
+	c.timers = append(c.timers, t)
+	close(c.added)
+	c.added = make(chan struct{})
+	return t
+}
+
+// Remove the timer, returning true if it was waiting.
+func (c *FakeClock) remove(t *fakeTimer) bool {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	for i, waiting := range c.timers {
+		if waiting == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type fakeTimer struct {
+	clock  *FakeClock
+	c      chan time.Time
+	at     time.Time
+	period time.Duration
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	return t.clock.remove(t)
+}
+
+type fakeTicker struct {
+	*fakeTimer
+}
+
+func (t fakeTicker) Stop() {
+	t.fakeTimer.Stop()
+}
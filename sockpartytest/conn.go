@@ -0,0 +1,202 @@
+package sockpartytest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/izzymg/sockparty"
+)
+
+// ErrNotPiped is returned by PipeTransport for requests not made by DialPipe.
+var ErrNotPiped = errors.New("Request wasn't dialed with DialPipe")
+
+// Number of messages buffered in each direction of a pipe.
+const pipeBuffer = 64
+
+/*
+Pipe returns both ends of an in-memory connection. Messages written to one end are read
+from the other, and pings are answered immediately while the pipe is open.
+Closing either end closes both with the status.
+*/
+func Pipe() (sockparty.Conn, sockparty.Conn) {
+	state := &pipeState{closed: make(chan struct{})}
+	a := make(chan pipeMessage, pipeBuffer)
+	b := make(chan pipeMessage, pipeBuffer)
+	return &pipeConn{read: a, write: b, state: state}, &pipeConn{read: b, write: a, state: state}
+}
+
+type pipeMessage struct {
+	typ  sockparty.MessageType
+	data []byte
+}
+
+// pipeState is shared by both ends of a pipe.
+type pipeState struct {
+	closed   chan struct{}
+	closeErr sockparty.CloseError
+	once     sync.Once
+}
+
+type pipeConn struct {
+	read  chan pipeMessage
+	write chan pipeMessage
+	state *pipeState
+}
+
+func (c *pipeConn) ReadMessage(ctx context.Context) (sockparty.MessageType, []byte, error) {
+	// Messages written before the pipe closed are still read.
+	select {
+	case message := <-c.read:
+		return message.typ, message.data, nil
+	default:
+	}
+	select {
+	case message := <-c.read:
+		return message.typ, message.data, nil
+	case <-c.state.closed:
+		return 0, nil, c.state.closeErr
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	}
+}
+
+func (c *pipeConn) WriteMessage(ctx context.Context, typ sockparty.MessageType, data []byte) error {
+	select {
+	case <-c.state.closed:
+		return c.state.closeErr
+	default:
+	}
+	message := pipeMessage{typ: typ, data: append([]byte(nil), data...)}
+	select {
+	case c.write <- message:
+		return nil
+	case <-c.state.closed:
+		return c.state.closeErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *pipeConn) Ping(ctx context.Context) error {
+	select {
+	case <-c.state.closed:
+		return c.state.closeErr
+	default:
+		return ctx.Err()
+	}
+}
+
+func (c *pipeConn) Close(code sockparty.StatusCode, reason string) error {
+	err := errors.New("Pipe already closed")
+	c.state.once.Do(func() {
+		c.state.closeErr = sockparty.CloseError{Code: code, Reason: reason}
+		close(c.state.closed)
+		err = nil
+	})
+	return err
+}
+
+func (c *pipeConn) Subprotocol() string {
+	return ""
+}
+
+type pipeKey struct{}
+
+/*
+PipeTransport accepts in-memory connections made by DialPipe. Set it as a party's Transport
+option to test without WebSocket.
+*/
+type PipeTransport struct{}
+
+// Accept returns the party's end of the pipe dialed by the request.
+func (PipeTransport) Accept(rw http.ResponseWriter, req *http.Request) (sockparty.Conn, error) {
+	conn, ok := req.Context().Value(pipeKey{}).(sockparty.Conn)
+	if !ok {
+		http.Error(rw, "Not a pipe", http.StatusBadRequest)
+		return nil, ErrNotPiped
+	}
+	return conn, nil
+}
+
+/*
+DialPipe connects a new client to a party using the PipeTransport, which serves it in the background.
+Requests to parties without the transport fail, and the client is closed.
+*/
+func DialPipe(handler http.Handler) *Client {
+	client, server := Pipe()
+	ctx := context.WithValue(context.Background(), pipeKey{}, server)
+	req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	go handler.ServeHTTP(httptest.NewRecorder(), req)
+	return NewClient(client)
+}
+
+// gorillaConn is a client's WebSocket connection, dialed by Dial.
+type gorillaConn struct {
+	conn *websocket.Conn
+	// Closed once reading fails, such as when the party replies to a close.
+	readFailed chan struct{}
+	once       sync.Once
+}
+
+func newGorillaConn(conn *websocket.Conn) *gorillaConn {
+	return &gorillaConn{
+		conn:       conn,
+		readFailed: make(chan struct{}),
+	}
+}
+
+func (c *gorillaConn) ReadMessage(ctx context.Context) (sockparty.MessageType, []byte, error) {
+	typ, data, err := c.conn.ReadMessage()
+	if err != nil {
+		c.once.Do(func() {
+			close(c.readFailed)
+		})
+		var closeErr *websocket.CloseError
+		if errors.As(err, &closeErr) {
+			return 0, nil, sockparty.CloseError{Code: sockparty.StatusCode(closeErr.Code), Reason: closeErr.Text}
+		}
+		return 0, nil, err
+	}
+	if typ == websocket.BinaryMessage {
+		return sockparty.MessageBinary, data, nil
+	}
+	return sockparty.MessageText, data, nil
+}
+
+func (c *gorillaConn) WriteMessage(ctx context.Context, typ sockparty.MessageType, data []byte) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetWriteDeadline(deadline)
+		defer c.conn.SetWriteDeadline(time.Time{})
+	}
+	if typ == sockparty.MessageBinary {
+		return c.conn.WriteMessage(websocket.BinaryMessage, data)
+	}
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func (c *gorillaConn) Ping(ctx context.Context) error {
+	return c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(DefaultTimeout))
+}
+
+// Close sends a close frame, and waits for the party's reply before closing the connection.
+func (c *gorillaConn) Close(code sockparty.StatusCode, reason string) error {
+	message := websocket.FormatCloseMessage(int(code), reason)
+	err := c.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+	if err == nil {
+		select {
+		case <-c.readFailed:
+		case <-time.After(time.Second):
+		}
+	}
+	return c.conn.Close()
+}
+
+func (c *gorillaConn) Subprotocol() string {
+	return c.conn.Subprotocol()
+}
@@ -0,0 +1,313 @@
+/*
+Package sockpartytest provides utilities for testing applications built with SockParty.
+
+Clients connect to a party in-process without a network, and record everything the party
+sends them so tests can wait on expected messages. A Recorder records a party's joins,
+leaves and incoming messages.
+*/
+package sockpartytest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/posener/wstest"
+
+	"github.com/izzymg/sockparty"
+)
+
+// DefaultTimeout is how long clients and recorders wait on expected events.
+const DefaultTimeout = time.Second * 5
+
+// Number of messages or events buffered before the party is blocked.
+const bufferSize = 256
+
+// ErrTimeout is returned when an expected message or event doesn't arrive in time.
+var ErrTimeout = errors.New("Timed out waiting")
+
+// ErrClosed is returned when waiting on a message from a client whose connection has closed.
+var ErrClosed = errors.New("Connection closed")
+
+/*
+SequentialIDs returns an ID generator which generates the prefix followed by 1, 2, 3...,
+so tests know the ID of each user joining.
+*/
+func SequentialIDs(prefix string) sockparty.UniqueIDGenerator {
+	var mut sync.Mutex
+	n := 0
+	return func() (string, error) {
+		mut.Lock()
+		defer mut.Unlock()
+		n++
+		return fmt.Sprintf("%s%d", prefix, n), nil
+	}
+}
+
+// Message is a message received by a client.
+type Message struct {
+	Event      sockparty.Event `json:"event"`
+	Payload    json.RawMessage `json:"payload"`
+	ServerTime float64         `json:"server_time"`
+	// Set for messages from a party through a Mux.
+	Party string `json:"party"`
+	// Set instead for binary messages.
+	Binary []byte `json:"-"`
+}
+
+// Decode unmarshals the message's payload into v.
+func (m *Message) Decode(v interface{}) error {
+	return json.Unmarshal(m.Payload, v)
+}
+
+// DialOptions configures a client's connection.
+type DialOptions struct {
+	Header            http.Header
+	Subprotocols      []string
+	EnableCompression bool
+}
+
+// Dial connects a new client to a party, or any other handler.
+func Dial(handler http.Handler) (*Client, error) {
+	return DialWith(handler, &DialOptions{})
+}
+
+// DialWith connects a new client to a party, or any other handler, with options.
+func DialWith(handler http.Handler, options *DialOptions) (*Client, error) {
+	d := wstest.NewDialer(handler)
+	d.Subprotocols = options.Subprotocols
+	d.EnableCompression = options.EnableCompression
+	conn, resp, err := d.Dial("ws://sockpartytest", options.Header)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("Dial failed with status %d: %w", resp.StatusCode, err)
+		}
+		return nil, fmt.Errorf("Dial failed: %w", err)
+	}
+	return NewClient(newGorillaConn(conn)), nil
+}
+
+/*
+NewClient creates a client from any connection to a party, such as the client's end
+of a Pipe, and begins reading from it.
+*/
+func NewClient(conn sockparty.Conn) *Client {
+	client := &Client{
+		Timeout:     DefaultTimeout,
+		Subprotocol: conn.Subprotocol(),
+		conn:        conn,
+		messages:    make(chan *Message, bufferSize),
+	}
+	go client.read()
+	return client
+}
+
+/*
+Client is a fake client connected to a party in-process. Everything the party sends is
+read in the background and buffered, so the party is never blocked on the client.
+*/
+type Client struct {
+	// How long to wait on expected messages.
+	Timeout time.Duration
+	// Subprotocol negotiated with the party.
+	Subprotocol string
+
+	conn     sockparty.Conn
+	messages chan *Message
+	closeErr error
+	writeMut sync.Mutex
+}
+
+// Send sends a message to the party. Safe to call concurrently.
+func (c *Client) Send(event sockparty.Event, payload interface{}) error {
+	data, err := json.Marshal(&sockparty.Outgoing{
+		Event:   event,
+		Payload: payload,
+	})
+	if err != nil {
+		return err
+	}
+	return c.write(sockparty.MessageText, data)
+}
+
+// SendTo sends a message to a party the client subscribed to through a Mux. Safe to call concurrently.
+func (c *Client) SendTo(party string, event sockparty.Event, payload interface{}) error {
+	data, err := json.Marshal(&struct {
+		Party   string          `json:"party"`
+		Event   sockparty.Event `json:"event"`
+		Payload interface{}     `json:"payload"`
+	}{party, event, payload})
+	if err != nil {
+		return err
+	}
+	return c.write(sockparty.MessageText, data)
+}
+
+// SendBinary sends a binary message to the party. Safe to call concurrently.
+func (c *Client) SendBinary(data []byte) error {
+	return c.write(sockparty.MessageBinary, data)
+}
+
+func (c *Client) write(typ sockparty.MessageType, data []byte) error {
+	c.writeMut.Lock()
+	defer c.writeMut.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	return c.conn.WriteMessage(ctx, typ, data)
+}
+
+// Next waits for the next message from the party.
+func (c *Client) Next() (*Message, error) {
+	select {
+	case message, ok := <-c.messages:
+		if !ok {
+			return nil, fmt.Errorf("%w: %v", ErrClosed, c.closeErr)
+		}
+		return message, nil
+	case <-time.After(c.Timeout):
+		return nil, fmt.Errorf("%w for a message", ErrTimeout)
+	}
+}
+
+// Expect waits for a message with the event, discarding any others received before it.
+func (c *Client) Expect(event sockparty.Event) (*Message, error) {
+	timeout := time.After(c.Timeout)
+	for {
+		select {
+		case message, ok := <-c.messages:
+			if !ok {
+				return nil, fmt.Errorf("%w waiting for %q: %v", ErrClosed, event, c.closeErr)
+			}
+			if message.Event == event {
+				return message, nil
+			}
+		case <-timeout:
+			return nil, fmt.Errorf("%w for %q", ErrTimeout, event)
+		}
+	}
+}
+
+// ExpectClose waits for the party to close the connection with the status code, discarding any messages.
+func (c *Client) ExpectClose(code sockparty.StatusCode) error {
+	timeout := time.After(c.Timeout)
+	for {
+		select {
+		case _, ok := <-c.messages:
+			if ok {
+				continue
+			}
+			var closeErr sockparty.CloseError
+			if !errors.As(c.closeErr, &closeErr) || closeErr.Code != code {
+				return fmt.Errorf("Expected close code %d, got: %v", code, c.closeErr)
+			}
+			return nil
+		case <-timeout:
+			return fmt.Errorf("%w for close", ErrTimeout)
+		}
+	}
+}
+
+// Close closes the client's connection normally.
+func (c *Client) Close() error {
+	return c.conn.Close(sockparty.StatusNormalClosure, "")
+}
+
+// Read everything from the connection until it closes.
+func (c *Client) read() {
+	defer close(c.messages)
+	for {
+		typ, data, err := c.conn.ReadMessage(context.Background())
+		if err != nil {
+			c.closeErr = err
+			return
+		}
+		message := &Message{}
+		if typ == sockparty.MessageBinary {
+			message.Binary = data
+		} else if err := json.Unmarshal(data, message); err != nil {
+			c.closeErr = fmt.Errorf("Invalid JSON from party: %w", err)
+			return
+		}
+		c.messages <- message
+	}
+}
+
+// Record begins recording a party's joins, leaves and incoming messages.
+func Record(party *sockparty.Party) *Recorder {
+	r := &Recorder{
+		Timeout:  DefaultTimeout,
+		joined:   make(chan string, bufferSize),
+		left:     make(chan string, bufferSize),
+		incoming: make(chan sockparty.Incoming, bufferSize),
+		binary:   make(chan sockparty.IncomingBinary, bufferSize),
+	}
+	r.unsubscribe = []sockparty.Unsubscribe{
+		party.SubscribeOnUserJoined(r.joined),
+		party.SubscribeOnUserLeft(r.left),
+		party.SubscribeIncoming(r.incoming),
+		party.SubscribeIncomingBinary(r.binary),
+	}
+	return r
+}
+
+// Recorder records a party's events, alongside any other subscribers.
+type Recorder struct {
+	// How long to wait on expected events.
+	Timeout time.Duration
+
+	joined      chan string
+	left        chan string
+	incoming    chan sockparty.Incoming
+	binary      chan sockparty.IncomingBinary
+	unsubscribe []sockparty.Unsubscribe
+}
+
+// ExpectJoin waits for the next user to join, returning their ID.
+func (r *Recorder) ExpectJoin() (string, error) {
+	return r.expectUser(r.joined, "join")
+}
+
+// ExpectLeave waits for the next user to leave, returning their ID.
+func (r *Recorder) ExpectLeave() (string, error) {
+	return r.expectUser(r.left, "leave")
+}
+
+// ExpectIncoming waits for the next incoming message.
+func (r *Recorder) ExpectIncoming() (sockparty.Incoming, error) {
+	select {
+	case message := <-r.incoming:
+		return message, nil
+	case <-time.After(r.Timeout):
+		return sockparty.Incoming{}, fmt.Errorf("%w for an incoming message", ErrTimeout)
+	}
+}
+
+// ExpectBinary waits for the next incoming binary message.
+func (r *Recorder) ExpectBinary() (sockparty.IncomingBinary, error) {
+	select {
+	case message := <-r.binary:
+		return message, nil
+	case <-time.After(r.Timeout):
+		return sockparty.IncomingBinary{}, fmt.Errorf("%w for an incoming binary message", ErrTimeout)
+	}
+}
+
+// Stop stops recording.
+func (r *Recorder) Stop() {
+	for _, unsubscribe := range r.unsubscribe {
+		unsubscribe()
+	}
+}
+
+func (r *Recorder) expectUser(ch chan string, what string) (string, error) {
+	select {
+	case id := <-ch:
+		return id, nil
+	case <-time.After(r.Timeout):
+		return "", fmt.Errorf("%w for a %s", ErrTimeout, what)
+	}
+}
@@ -0,0 +1,193 @@
+package sockpartytest_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"github.com/izzymg/sockparty"
+	"github.com/izzymg/sockparty/sockpartytest"
+)
+
+// Test clients exchange messages with a party, which records their events.
+func TestClient(t *testing.T) {
+	is := is.New(t)
+
+	party := sockparty.New(sockpartytest.SequentialIDs("user"), &sockparty.Options{
+		PingFrequency: 0,
+	})
+	recorder := sockpartytest.Record(party)
+	defer recorder.Stop()
+
+	c, err := sockpartytest.Dial(party)
+	is.NoErr(err)
+	defer c.Close()
+	id, err := recorder.ExpectJoin()
+	is.NoErr(err)
+	is.Equal(id, "user1")
+
+	// Client to party
+	is.NoErr(c.Send("chat_message", "hello"))
+	incoming, err := recorder.ExpectIncoming()
+	is.NoErr(err)
+	is.Equal(incoming.UserID, "user1")
+	is.Equal(incoming.Event, sockparty.Event("chat_message"))
+
+	is.NoErr(c.SendBinary([]byte("blob")))
+	binary, err := recorder.ExpectBinary()
+	is.NoErr(err)
+	is.Equal(binary.Data, []byte("blob"))
+
+	// Party to client, skipping other events.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	is.NoErr(party.Broadcast(ctx, &sockparty.Outgoing{Event: "ignored"}))
+	is.NoErr(party.Broadcast(ctx, &sockparty.Outgoing{Event: "chat_message", Payload: "hi"}))
+	message, err := c.Expect("chat_message")
+	is.NoErr(err)
+	var payload string
+	is.NoErr(message.Decode(&payload))
+	is.Equal(payload, "hi")
+
+	// Nothing else is coming.
+	c.Timeout = time.Millisecond * 50
+	_, err = c.Next()
+	is.True(errors.Is(err, sockpartytest.ErrTimeout))
+
+	is.NoErr(c.Close())
+	id, err = recorder.ExpectLeave()
+	is.NoErr(err)
+	is.Equal(id, "user1")
+}
+
+// Test clients report unexpected close codes.
+func TestExpectClose(t *testing.T) {
+	is := is.New(t)
+
+	party := sockparty.New(sockpartytest.SequentialIDs("user"), &sockparty.Options{
+		PingFrequency: 0,
+		Subprotocols:  []string{"v1"},
+		CheckSubprotocol: func(subprotocol string) bool {
+			return subprotocol == "v1"
+		},
+	})
+	recorder := sockpartytest.Record(party)
+	defer recorder.Stop()
+
+	c, err := sockpartytest.Dial(party)
+	is.NoErr(err)
+	defer c.Close()
+	is.True(c.ExpectClose(sockparty.StatusNormalClosure) != nil)
+
+	c, err = sockpartytest.DialWith(party, &sockpartytest.DialOptions{
+		Subprotocols: []string{"v1"},
+	})
+	is.NoErr(err)
+	defer c.Close()
+	is.Equal(c.Subprotocol, "v1")
+	_, err = recorder.ExpectJoin()
+	is.NoErr(err)
+
+	party.End("Bye")
+	is.NoErr(c.ExpectClose(sockparty.StatusNormalClosure))
+}
+
+// Test sequential IDs are generated in order.
+func TestSequentialIDs(t *testing.T) {
+	is := is.New(t)
+
+	generate := sockpartytest.SequentialIDs("guest")
+	for _, expected := range []string{"guest1", "guest2", "guest3"} {
+		id, err := generate()
+		is.NoErr(err)
+		is.Equal(id, expected)
+	}
+}
+
+// Test fake timers and tickers fire only when the clock is advanced.
+func TestFakeClock(t *testing.T) {
+	is := is.New(t)
+
+	start := time.Unix(0, 0)
+	clock := sockpartytest.NewFakeClock(start)
+	timer := clock.NewTimer(time.Second)
+	ticker := clock.NewTicker(time.Second * 2)
+	stopped := clock.NewTimer(time.Second)
+	clock.BlockUntil(3)
+	is.True(stopped.Stop())
+	is.True(!stopped.Stop())
+
+	fired := func(c <-chan time.Time) bool {
+		select {
+		case <-c:
+			return true
+		default:
+			return false
+		}
+	}
+
+	clock.Advance(time.Millisecond * 999)
+	is.True(!fired(timer.C()))
+	clock.Advance(time.Millisecond)
+	is.Equal(<-timer.C(), start.Add(time.Second))
+	is.True(!fired(ticker.C()))
+	is.True(!fired(stopped.C()))
+
+	// Tickers tick once, however far they're advanced.
+	clock.Advance(time.Second * 5)
+	is.True(fired(ticker.C()))
+	is.True(!fired(ticker.C()))
+	clock.Advance(time.Second)
+	is.True(!fired(ticker.C()))
+	clock.Advance(time.Second)
+	is.True(fired(ticker.C()))
+	is.Equal(clock.Now(), start.Add(time.Second*8))
+
+	ticker.Stop()
+	clock.Advance(time.Second * 2)
+	is.True(!fired(ticker.C()))
+	is.True(!timer.Stop())
+}
+
+// Test clients join parties over in-memory pipes.
+func TestPipe(t *testing.T) {
+	is := is.New(t)
+
+	party := sockparty.New(sockpartytest.SequentialIDs("user"), &sockparty.Options{
+		PingFrequency: 0,
+		Transport:     sockpartytest.PipeTransport{},
+	})
+	recorder := sockpartytest.Record(party)
+	defer recorder.Stop()
+
+	c := sockpartytest.DialPipe(party)
+	id, err := recorder.ExpectJoin()
+	is.NoErr(err)
+	is.NoErr(c.Send("chat_message", "hi"))
+	incoming, err := recorder.ExpectIncoming()
+	is.NoErr(err)
+	is.Equal(incoming.UserID, id)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	is.NoErr(party.SendBinary(ctx, id, []byte("blob")))
+	message, err := c.Next()
+	is.NoErr(err)
+	is.Equal(message.Binary, []byte("blob"))
+
+	is.NoErr(party.Kick(id, "Bye"))
+	is.NoErr(c.ExpectClose(sockparty.StatusPolicyViolation))
+	_, err = recorder.ExpectLeave()
+	is.NoErr(err)
+
+	// Closing the client leaves the party.
+	c = sockpartytest.DialPipe(party)
+	_, err = recorder.ExpectJoin()
+	is.NoErr(err)
+	is.NoErr(c.Close())
+	_, err = recorder.ExpectLeave()
+	is.NoErr(err)
+}
@@ -0,0 +1,369 @@
+package sockparty
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrNoSuchKey is returned when an invalid state key is looked up.
+var ErrNoSuchKey = errors.New("No such key found in state")
+
+// StateSnapshot is the payload of an EventState message, containing the full state.
+type StateSnapshot struct {
+	Version uint64                 `json:"version"`
+	State   map[string]interface{} `json:"state"`
+}
+
+/*
+StatePatch is the payload of an EventStatePatch message, containing a JSON Patch (RFC 6902)
+to apply to the state. Each patch increments the version by exactly one, so clients which
+see a gap in versions have missed a patch and should request a new snapshot.
+*/
+type StatePatch struct {
+	Version uint64           `json:"version"`
+	Patch   []PatchOperation `json:"patch"`
+}
+
+// PatchOperation is a single JSON Patch operation.
+type PatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// Number of recent patches kept, so users who fall behind can be sent what they missed.
+// Users further behind are sent a snapshot instead.
+const statePatchLog = 64
+
+// stateUpdate is a patch or snapshot ready to send to users, and the version it brings them to.
+type stateUpdate struct {
+	version uint64
+	message *PreparedMessage
+}
+
+func newState(party *Party) *State {
+	return &State{
+		party:  party,
+		values: make(map[string]interface{}),
+	}
+}
+
+/*
+State is a key-value store shared by everyone in a party. Values are set by the server,
+and changes are broadcast to all users as JSON patches. Users joining the party are sent
+a snapshot of the state, once it has been set.
+*/
+type State struct {
+	party   *Party
+	version uint64
+	values  map[string]interface{}
+	patches []stateUpdate
+	mut     sync.Mutex
+}
+
+// Version returns the current state version, which is incremented on every change.
+func (state *State) Version() uint64 {
+	state.mut.Lock()
+	defer state.mut.Unlock()
+	return state.version
+}
+
+// Get unmarshals the value stored under key into v.
+func (state *State) Get(key string, v interface{}) error {
+	state.mut.Lock()
+	value, ok := state.values[key]
+	state.mut.Unlock()
+	if !ok {
+		return ErrNoSuchKey
+	}
+	// Stored values are already valid JSON.
+	raw, _ := json.Marshal(value)
+	return json.Unmarshal(raw, v)
+}
+
+// Snapshot returns a copy of the full state.
+func (state *State) Snapshot() *StateSnapshot {
+	state.mut.Lock()
+	defer state.mut.Unlock()
+	return state.snapshot()
+}
+
+/*
+Set stores value under key, broadcasting the changes to all users.
+The value must be JSON serializable. Setting a value identical to the existing one does nothing.
+*/
+func (state *State) Set(ctx context.Context, key string, value interface{}) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("Marshal state value failed: %w", err)
+	}
+	var decoded interface{}
+	err = json.Unmarshal(raw, &decoded)
+	if err != nil {
+		return fmt.Errorf("Unmarshal state value failed: %w", err)
+	}
+
+	state.mut.Lock()
+	path := "/" + escapePointer(key)
+	var patch []PatchOperation
+	if existing, ok := state.values[key]; ok {
+		patch = diffJSON(path, existing, decoded, nil)
+	} else {
+		patch = []PatchOperation{{Op: "add", Path: path, Value: raw}}
+	}
+	if len(patch) == 0 {
+		state.mut.Unlock()
+		return nil
+	}
+	state.values[key] = decoded
+	err = state.publish(patch)
+	state.mut.Unlock()
+	if err != nil {
+		return err
+	}
+	state.broadcast(ctx)
+	return nil
+}
+
+// Delete removes key from the state, broadcasting the change to all users.
+func (state *State) Delete(ctx context.Context, key string) error {
+	state.mut.Lock()
+	if _, ok := state.values[key]; !ok {
+		state.mut.Unlock()
+		return ErrNoSuchKey
+	}
+	delete(state.values, key)
+	err := state.publish([]PatchOperation{{Op: "remove", Path: "/" + escapePointer(key)}})
+	state.mut.Unlock()
+	if err != nil {
+		return err
+	}
+	state.broadcast(ctx)
+	return nil
+}
+
+/* Patches are logged rather than broadcast under the state lock. Each user tracks the version
+they've been sent, and is sent whatever they're missing under their own lock, so every user
+sees every patch after their snapshot exactly once, in order, and a slow user only holds up
+their own updates. */
+
+// Increment the version and log a patch. Must be called with the lock held.
+func (state *State) publish(patch []PatchOperation) error {
+	message, err := NewPreparedMessage(&Outgoing{
+		Event: EventStatePatch,
+		Payload: &StatePatch{
+			Version: state.version + 1,
+			Patch:   patch,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	state.version++
+	state.patches = append(state.patches, stateUpdate{version: state.version, message: message})
+	if len(state.patches) > statePatchLog {
+		state.patches = append(state.patches[:0:0], state.patches[len(state.patches)-statePatchLog:]...)
+	}
+	return nil
+}
+
+// Send every user the patches they're missing.
+func (state *State) broadcast(ctx context.Context) {
+	for _, usr := range state.party.users() {
+		usr.syncState(ctx)
+	}
+}
+
+/*
+Get the updates which bring a user up to date from the version they were last sent: the patches
+since, or a snapshot if they're too far behind. Users who haven't been sent the state yet are
+sent a snapshot, once it has been set.
+*/
+func (state *State) updatesSince(version uint64, synced bool) ([]stateUpdate, error) {
+	state.mut.Lock()
+	defer state.mut.Unlock()
+	if state.version == 0 || (synced && version == state.version) {
+		return nil, nil
+	}
+	if synced && len(state.patches) > 0 && state.patches[0].version <= version+1 {
+		missed := state.patches[version+1-state.patches[0].version:]
+		return append([]stateUpdate(nil), missed...), nil
+	}
+	update, err := state.snapshotUpdate()
+	if err != nil {
+		return nil, err
+	}
+	return []stateUpdate{update}, nil
+}
+
+// Copy the state into a snapshot. Must be called with the lock held.
+func (state *State) snapshot() *StateSnapshot {
+	values := make(map[string]interface{}, len(state.values))
+	for key, value := range state.values {
+		values[key] = value
+	}
+	return &StateSnapshot{
+		Version: state.version,
+		State:   values,
+	}
+}
+
+// Prepare a snapshot to send to users. Must be called with the lock held.
+func (state *State) snapshotUpdate() (stateUpdate, error) {
+	message, err := NewPreparedMessage(&Outgoing{
+		Event:   EventState,
+		Payload: state.snapshot(),
+	})
+	if err != nil {
+		return stateUpdate{}, err
+	}
+	return stateUpdate{version: state.version, message: message}, nil
+}
+
+/*
+Send the user whatever they're missing of their party's state, in order, and only once.
+Only one routine sends a user updates at a time, and it keeps going until they're up to date,
+so others don't wait on a slow user. If it fails, what's missing is sent on the next change.
+*/
+func (usr *User) syncState(ctx context.Context) error {
+	usr.stateMut.Lock()
+	defer usr.stateMut.Unlock()
+	if usr.stateSyncing {
+		return nil
+	}
+	usr.stateSyncing = true
+	defer func() {
+		usr.stateSyncing = false
+	}()
+
+	for {
+		// Users may be transferred while they're sent updates.
+		state := usr.currentParty().state
+		updates, err := usr.missedState(state)
+		if err != nil || len(updates) == 0 {
+			return err
+		}
+
+		usr.stateMut.Unlock()
+		sent := 0
+		for _, update := range updates {
+			err = usr.writePrepared(ctx, update.message)
+			if err != nil {
+				break
+			}
+			sent++
+		}
+		usr.stateMut.Lock()
+		if sent > 0 {
+			usr.syncedState = state
+			usr.stateVersion = updates[sent-1].version
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Get the updates the user is missing from the state. Must be called with the user's state lock held.
+func (usr *User) missedState(state *State) ([]stateUpdate, error) {
+	// Users transferred from another party's state are sent a snapshot, even if it's empty.
+	if usr.stateResync || (usr.syncedState != nil && usr.syncedState != state) {
+		usr.stateResync = false
+		state.mut.Lock()
+		update, err := state.snapshotUpdate()
+		state.mut.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		return []stateUpdate{update}, nil
+	}
+	updates, err := state.updatesSince(usr.stateVersion, usr.syncedState == state)
+	if err == nil && len(updates) == 0 && usr.syncedState != state {
+		// Joined before the state was set, so any patch is news.
+		usr.syncedState = state
+		usr.stateVersion = 0
+	}
+	return updates, err
+}
+
+// Send the user a new snapshot of their party's state, such as when they've missed a patch.
+func (usr *User) resyncState(ctx context.Context) error {
+	usr.stateMut.Lock()
+	usr.stateResync = true
+	usr.stateMut.Unlock()
+	return usr.syncState(ctx)
+}
+
+// Append the JSON patch operations required to turn from into to, where both are decoded JSON.
+func diffJSON(path string, from interface{}, to interface{}, patch []PatchOperation) []PatchOperation {
+	switch fromValue := from.(type) {
+	case map[string]interface{}:
+		toValue, ok := to.(map[string]interface{})
+		if !ok {
+			break
+		}
+		// Sort keys so patches are deterministic.
+		keys := make([]string, 0, len(fromValue)+len(toValue))
+		for key := range fromValue {
+			keys = append(keys, key)
+		}
+		for key := range toValue {
+			if _, ok := fromValue[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			keyPath := path + "/" + escapePointer(key)
+			fromChild, inFrom := fromValue[key]
+			toChild, inTo := toValue[key]
+			switch {
+			case !inTo:
+				patch = append(patch, PatchOperation{Op: "remove", Path: keyPath})
+			case !inFrom:
+				patch = append(patch, PatchOperation{Op: "add", Path: keyPath, Value: mustMarshal(toChild)})
+			default:
+				patch = diffJSON(keyPath, fromChild, toChild, patch)
+			}
+		}
+		return patch
+
+	case []interface{}:
+		// Arrays of different lengths are replaced outright.
+		toValue, ok := to.([]interface{})
+		if !ok || len(fromValue) != len(toValue) {
+			break
+		}
+		for i := range fromValue {
+			patch = diffJSON(path+"/"+strconv.Itoa(i), fromValue[i], toValue[i], patch)
+		}
+		return patch
+	}
+
+	if reflect.DeepEqual(from, to) {
+		return patch
+	}
+	return append(patch, PatchOperation{Op: "replace", Path: path, Value: mustMarshal(to)})
+}
+
+// Escape a key for use in a JSON pointer (RFC 6901).
+func escapePointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
+
+// Marshal decoded JSON, which cannot fail.
+func mustMarshal(v interface{}) json.RawMessage {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return raw
+}
@@ -0,0 +1,167 @@
+package sockparty_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/matryer/is"
+	"github.com/posener/wstest"
+
+	"github.com/izzymg/sockparty"
+)
+
+type stateMessage struct {
+	Event   sockparty.Event `json:"event"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+/* Read messages from a connection in the background, as test connections
+are synchronous and block the party's writes until read. */
+func readMessages(c *websocket.Conn) <-chan stateMessage {
+	messages := make(chan stateMessage, 16)
+	go func() {
+		defer close(messages)
+		for {
+			var message stateMessage
+			if err := c.ReadJSON(&message); err != nil {
+				return
+			}
+			messages <- message
+		}
+	}()
+	return messages
+}
+
+type playlist struct {
+	Current string   `json:"current"`
+	Videos  []string `json:"videos"`
+}
+
+// Test joining users get a snapshot, and changes are broadcast as patches.
+func TestState(t *testing.T) {
+	is := is.New(t)
+
+	party := sockparty.New(generateUID, &sockparty.Options{
+		PingFrequency: 0,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	// Set state before anyone joins.
+	state := party.State()
+	err := state.Set(ctx, "playlist", &playlist{Current: "a", Videos: []string{"a", "b"}})
+	is.NoErr(err)
+	is.Equal(state.Version(), uint64(1))
+
+	var fetched playlist
+	is.NoErr(state.Get("playlist", &fetched))
+	is.Equal(fetched.Current, "a")
+	is.Equal(state.Get("nothing", &fetched), sockparty.ErrNoSuchKey)
+
+	userJoined := make(chan string)
+	party.RegisterOnUserJoined(userJoined)
+	d := wstest.NewDialer(party)
+	c, _, err := d.Dial(addr, nil)
+	is.NoErr(err)
+	defer c.Close()
+	messages := readMessages(c)
+	<-userJoined
+
+	// Snapshot on join
+	message := <-messages
+	is.Equal(message.Event, sockparty.EventState)
+	var snapshot sockparty.StateSnapshot
+	is.NoErr(json.Unmarshal(message.Payload, &snapshot))
+	is.Equal(snapshot.Version, uint64(1))
+	is.True(snapshot.State["playlist"] != nil)
+
+	// Setting an identical value does nothing.
+	err = state.Set(ctx, "playlist", &playlist{Current: "a", Videos: []string{"a", "b"}})
+	is.NoErr(err)
+	is.Equal(state.Version(), uint64(1))
+
+	// Changes are diffed.
+	err = state.Set(ctx, "playlist", &playlist{Current: "b", Videos: []string{"a", "b"}})
+	is.NoErr(err)
+	message = <-messages
+	is.Equal(message.Event, sockparty.EventStatePatch)
+	var patch sockparty.StatePatch
+	is.NoErr(json.Unmarshal(message.Payload, &patch))
+	is.Equal(patch.Version, uint64(2))
+	is.Equal(len(patch.Patch), 1)
+	is.Equal(patch.Patch[0].Op, "replace")
+	is.Equal(patch.Patch[0].Path, "/playlist/current")
+	is.Equal(string(patch.Patch[0].Value), `"b"`)
+
+	// Deletes are removals.
+	is.NoErr(state.Delete(ctx, "playlist"))
+	message = <-messages
+	is.NoErr(json.Unmarshal(message.Payload, &patch))
+	is.Equal(patch.Version, uint64(3))
+	is.Equal(patch.Patch[0].Op, "remove")
+	is.Equal(state.Delete(ctx, "playlist"), sockparty.ErrNoSuchKey)
+
+	// Users can request a new snapshot.
+	is.NoErr(c.WriteJSON(&sockparty.Outgoing{Event: sockparty.EventState}))
+	message = <-messages
+	is.Equal(message.Event, sockparty.EventState)
+	snapshot = sockparty.StateSnapshot{}
+	is.NoErr(json.Unmarshal(message.Payload, &snapshot))
+	is.Equal(snapshot.Version, uint64(3))
+	is.Equal(len(snapshot.State), 0)
+}
+
+// Test a user who isn't reading doesn't hold up state changes, or others joining.
+func TestStateSlowUser(t *testing.T) {
+	is := is.New(t)
+
+	party := sockparty.New(generateUID, &sockparty.Options{
+		PingFrequency: 0,
+	})
+	userJoined := make(chan string, 2)
+	party.RegisterOnUserJoined(userJoined)
+	state := party.State()
+
+	// Never read from, so writes to them block.
+	d := wstest.NewDialer(party)
+	slow, _, err := d.Dial(addr, nil)
+	is.NoErr(err)
+	defer slow.Close()
+	<-userJoined
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	set := make(chan error, 1)
+	go func() {
+		set <- state.Set(ctx, "round", 1)
+	}()
+	timeout := time.After(time.Second * 5)
+	for state.Version() != 1 {
+		select {
+		case <-timeout:
+			t.Fatal("Timed out waiting for state version")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	c, _, err := wstest.NewDialer(party).Dial(addr, nil)
+	is.NoErr(err)
+	defer c.Close()
+	messages := readMessages(c)
+	<-userJoined
+	message := <-messages
+	is.Equal(message.Event, sockparty.EventState)
+
+	// The patch isn't sent to the new user, as the snapshot already had it.
+	is.NoErr(state.Set(context.Background(), "round", 2))
+	var patch sockparty.StatePatch
+	message = <-messages
+	is.Equal(message.Event, sockparty.EventStatePatch)
+	is.NoErr(json.Unmarshal(message.Payload, &patch))
+	is.Equal(patch.Version, uint64(2))
+	cancel()
+	is.NoErr(<-set)
+}
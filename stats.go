@@ -0,0 +1,30 @@
+package sockparty
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats holds counts of the messages passed through a party since it was created.
+type Stats struct {
+	// Messages received from users, JSON or binary.
+	Received uint64 `json:"received"`
+	// Messages written to users, a broadcast counts once for each user.
+	Sent uint64 `json:"sent"`
+	// Incoming messages dropped, see DroppedMessages.
+	Dropped uint64 `json:"dropped"`
+}
+
+// Stats returns counts of the messages passed through the party.
+func (party *Party) Stats() Stats {
+	return Stats{
+		Received: atomic.LoadUint64(&party.received),
+		Sent:     atomic.LoadUint64(&party.sent),
+		Dropped:  atomic.LoadUint64(&party.dropped),
+	}
+}
+
+// Uptime returns how long ago the party was created.
+func (party *Party) Uptime() time.Duration {
+	return party.opts.clock().Now().Sub(party.created)
+}
@@ -0,0 +1,187 @@
+package sockparty
+
+import (
+	"context"
+	"sync"
+)
+
+// Unsubscribe stops a subscription's channel from receiving events. It is safe to call more than once.
+type Unsubscribe func()
+
+// Subscription ID used by the Register methods, which replace rather than add.
+const registeredID = 0
+
+func newSubscriptions() *subscriptions {
+	return &subscriptions{
+		nextID:   registeredID + 1,
+		incoming: make(map[int]subscriber),
+		binary:   make(map[int]subscriber),
+		joined:   make(map[int]subscriber),
+		left:     make(map[int]subscriber),
+	}
+}
+
+// subscriber is a subscribed channel, with a done channel closed when it's unsubscribed or replaced.
+type subscriber struct {
+	ch   interface{}
+	done chan struct{}
+}
+
+// subscriptions holds the channels subscribed to a party's events.
+type subscriptions struct {
+	mut      sync.RWMutex
+	nextID   int
+	incoming map[int]subscriber
+	binary   map[int]subscriber
+	joined   map[int]subscriber
+	left     map[int]subscriber
+}
+
+// Add a channel to a set of subscriptions under id, replacing any there, or remove it if ch is nil.
+func (subs *subscriptions) set(set map[int]subscriber, id int, ch interface{}) {
+	subs.mut.Lock()
+	defer subs.mut.Unlock()
+	if existing, ok := set[id]; ok {
+		close(existing.done)
+		delete(set, id)
+	}
+	if ch != nil {
+		set[id] = subscriber{ch: ch, done: make(chan struct{})}
+	}
+}
+
+// Add a user ID channel to a set of subscriptions under id, or remove it if the channel is nil.
+func (subs *subscriptions) setUserChannel(set map[int]subscriber, id int, ch chan string) {
+	if ch == nil {
+		subs.set(set, id, nil)
+		return
+	}
+	subs.set(set, id, ch)
+}
+
+// Add an incoming channel under id, or remove it if the channel is nil.
+func (subs *subscriptions) setIncoming(id int, ch chan Incoming) {
+	if ch == nil {
+		subs.set(subs.incoming, id, nil)
+		return
+	}
+	subs.set(subs.incoming, id, ch)
+}
+
+// Add a binary channel under id, or remove it if the channel is nil.
+func (subs *subscriptions) setBinary(id int, ch chan IncomingBinary) {
+	if ch == nil {
+		subs.set(subs.binary, id, nil)
+		return
+	}
+	subs.set(subs.binary, id, ch)
+}
+
+// Reserve a new subscription ID.
+func (subs *subscriptions) newID() int {
+	subs.mut.Lock()
+	defer subs.mut.Unlock()
+	id := subs.nextID
+	subs.nextID++
+	return id
+}
+
+/* Channels are copied out before sending so the lock isn't held while blocked on a consumer.
+Sends are abandoned once the channel is unsubscribed, so consumers can always stop receiving
+by unsubscribing, even while the party is blocked sending to them. */
+
+/*
+Send to every subscriber in a set, returning false if send does. Send is called with each
+subscriber's channel, and must give up once done is closed.
+*/
+func (subs *subscriptions) publish(set map[int]subscriber, send func(ch interface{}, done <-chan struct{}) bool) bool {
+	subs.mut.RLock()
+	subscribers := make([]subscriber, 0, len(set))
+	for _, sub := range set {
+		subscribers = append(subscribers, sub)
+	}
+	subs.mut.RUnlock()
+
+	for _, sub := range subscribers {
+		if !send(sub.ch, sub.done) {
+			return false
+		}
+	}
+	return true
+}
+
+// Send a message to every incoming channel, returning false if the context is canceled first.
+func (subs *subscriptions) publishIncoming(ctx context.Context, message Incoming) bool {
+	return subs.publish(subs.incoming, func(ch interface{}, done <-chan struct{}) bool {
+		select {
+		case ch.(chan Incoming) <- message:
+		case <-done:
+		case <-ctx.Done():
+			return false
+		}
+		return true
+	})
+}
+
+// Send a binary message to every binary channel, returning false if the context is canceled first.
+func (subs *subscriptions) publishBinary(ctx context.Context, message IncomingBinary) bool {
+	return subs.publish(subs.binary, func(ch interface{}, done <-chan struct{}) bool {
+		select {
+		case ch.(chan IncomingBinary) <- message:
+		case <-done:
+		case <-ctx.Done():
+			return false
+		}
+		return true
+	})
+}
+
+// Send a user ID to every channel in a set of subscriptions, returning false if the context is canceled first.
+func (subs *subscriptions) publishUser(ctx context.Context, set map[int]subscriber, userID string) bool {
+	return subs.publish(set, func(ch interface{}, done <-chan struct{}) bool {
+		select {
+		case ch.(chan string) <- userID:
+		case <-done:
+		case <-ctx.Done():
+			return false
+		}
+		return true
+	})
+}
+
+/*
+SubscribeIncoming adds a channel to receive all incoming user messages, alongside
+any others subscribed or registered. Every subscriber must receive from their channel
+to avoid blocking the party.
+*/
+func (party *Party) SubscribeIncoming(ch chan Incoming) Unsubscribe {
+	id := party.subs.newID()
+	party.subs.setIncoming(id, ch)
+	return func() {
+		party.subs.setIncoming(id, nil)
+	}
+}
+
+/*
+SubscribeOnUserJoined adds a channel to receive the IDs of users who have joined,
+alongside any others subscribed or registered. See RegisterOnUserJoined.
+*/
+func (party *Party) SubscribeOnUserJoined(ch chan string) Unsubscribe {
+	id := party.subs.newID()
+	party.subs.setUserChannel(party.subs.joined, id, ch)
+	return func() {
+		party.subs.setUserChannel(party.subs.joined, id, nil)
+	}
+}
+
+/*
+SubscribeOnUserLeft adds a channel to receive the IDs of users who have left,
+alongside any others subscribed or registered. See RegisterOnUserLeft.
+*/
+func (party *Party) SubscribeOnUserLeft(ch chan string) Unsubscribe {
+	id := party.subs.newID()
+	party.subs.setUserChannel(party.subs.left, id, ch)
+	return func() {
+		party.subs.setUserChannel(party.subs.left, id, nil)
+	}
+}
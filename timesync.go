@@ -0,0 +1,65 @@
+package sockparty
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrNoSamples is returned when estimating a clock offset without any samples.
+var ErrNoSamples = errors.New("No time sync samples to estimate from")
+
+/*
+TimeSync is the payload of an NTP-style time sync exchange, with times in
+milliseconds since the Unix epoch. A client sends an EventTimeSync message
+with ClientSend set, and the server replies with the same payload, filling in
+when it received and replied to the message.
+*/
+type TimeSync struct {
+	ClientSend    float64 `json:"client_send"`
+	ServerReceive float64 `json:"server_receive"`
+	ServerSend    float64 `json:"server_send"`
+}
+
+// TimeSyncSample is a completed time sync exchange, as recorded by a client.
+type TimeSyncSample struct {
+	TimeSync
+	// Time the client received the server's reply, in milliseconds since the Unix epoch.
+	ClientReceive float64
+}
+
+// Offset returns how far the server's clock is ahead of the client's.
+func (s TimeSyncSample) Offset() time.Duration {
+	return millisDuration(((s.ServerReceive - s.ClientSend) + (s.ServerSend - s.ClientReceive)) / 2)
+}
+
+// RoundTrip returns the network round trip time, excluding the server's processing time.
+func (s TimeSyncSample) RoundTrip() time.Duration {
+	return millisDuration((s.ClientReceive - s.ClientSend) - (s.ServerSend - s.ServerReceive))
+}
+
+/*
+EstimateClockOffset estimates the offset between a client and server's clocks
+from multiple time sync samples. The sample with the lowest round trip time is
+the least affected by network delay, so its offset and round trip are returned.
+*/
+func EstimateClockOffset(samples []TimeSyncSample) (offset time.Duration, rtt time.Duration, err error) {
+	if len(samples) == 0 {
+		return 0, 0, ErrNoSamples
+	}
+	best := samples[0]
+	for _, sample := range samples[1:] {
+		if sample.RoundTrip() < best.RoundTrip() {
+			best = sample
+		}
+	}
+	return best.Offset(), best.RoundTrip(), nil
+}
+
+// UnixMillis returns t as milliseconds since the Unix epoch, the time format used by SockParty messages.
+func UnixMillis(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Millisecond)
+}
+
+func millisDuration(ms float64) time.Duration {
+	return time.Duration(ms * float64(time.Millisecond))
+}
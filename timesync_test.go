@@ -0,0 +1,87 @@
+package sockparty_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/posener/wstest"
+
+	"github.com/izzymg/sockparty"
+)
+
+// Test the lowest round trip sample is used to estimate the offset.
+func TestEstimateClockOffset(t *testing.T) {
+	is := is.New(t)
+
+	_, _, err := sockparty.EstimateClockOffset(nil)
+	is.Equal(err, sockparty.ErrNoSamples)
+
+	// Server is 100ms ahead, first sample has asymmetric network delay.
+	samples := []sockparty.TimeSyncSample{
+		{
+			TimeSync:      sockparty.TimeSync{ClientSend: 1000, ServerReceive: 1180, ServerSend: 1181},
+			ClientReceive: 1091,
+		},
+		{
+			TimeSync:      sockparty.TimeSync{ClientSend: 2000, ServerReceive: 2110, ServerSend: 2111},
+			ClientReceive: 2021,
+		},
+	}
+	offset, rtt, err := sockparty.EstimateClockOffset(samples)
+	is.NoErr(err)
+	is.Equal(offset, time.Millisecond*100)
+	is.Equal(rtt, time.Millisecond*20)
+}
+
+// Test the server replies to time sync requests over the connection.
+func TestTimeSync(t *testing.T) {
+	is := is.New(t)
+
+	party := sockparty.New(generateUID, &sockparty.Options{
+		PingFrequency: 0,
+	})
+
+	d := wstest.NewDialer(party)
+	c, _, err := d.Dial(addr, nil)
+	is.NoErr(err)
+	defer c.Close()
+
+	var samples []sockparty.TimeSyncSample
+	for i := 0; i < 3; i++ {
+		err = c.WriteJSON(&sockparty.Outgoing{
+			Event:   sockparty.EventTimeSync,
+			Payload: sockparty.TimeSync{ClientSend: sockparty.UnixMillis(time.Now())},
+		})
+		is.NoErr(err)
+
+		var reply struct {
+			Event   sockparty.Event    `json:"event"`
+			Payload sockparty.TimeSync `json:"payload"`
+		}
+		err = c.ReadJSON(&reply)
+		is.NoErr(err)
+		is.Equal(reply.Event, sockparty.EventTimeSync)
+		samples = append(samples, sockparty.TimeSyncSample{
+			TimeSync:      reply.Payload,
+			ClientReceive: sockparty.UnixMillis(time.Now()),
+		})
+	}
+
+	// Same clock, so the offset can only be off by the round trip.
+	offset, rtt, err := sockparty.EstimateClockOffset(samples)
+	is.NoErr(err)
+	is.True(rtt >= 0)
+	if offset < 0 {
+		offset = -offset
+	}
+	is.True(offset <= rtt)
+}
+
+// Test stamping outgoing messages with the server's time.
+func TestStamp(t *testing.T) {
+	is := is.New(t)
+	before := sockparty.UnixMillis(time.Now())
+	message := (&sockparty.Outgoing{Event: "test_event"}).Stamp()
+	is.True(message.ServerTime >= before)
+}
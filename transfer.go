@@ -0,0 +1,157 @@
+package sockparty
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrCannotTransfer is returned when transferring a user subscribed through a Mux.
+var ErrCannotTransfer = errors.New("Users subscribed through a Mux can't be transferred")
+
+// Serializes transfers, which lock two parties at once.
+var transferMut sync.Mutex
+
+/*
+Transfer moves a user to another party without reconnecting them, keeping their ID, connection and roles.
+They're removed from this party and added to the target at once, failing if the target has a user with the
+same ID. Like on join, they're sent the target's state, until the context is canceled. Messages the user sent
+before the transfer are delivered to this party, then leave is fired on it and join on the target, so this
+party's handlers receive nothing from the user after they leave.
+The user keeps the options of the party they joined, such as pings and rate limits.
+Users subscribed through a Mux subscribe to parties themselves, and can't be transferred.
+*/
+func (party *Party) Transfer(ctx context.Context, userID string, target *Party) error {
+	if target == party {
+		return nil
+	}
+	transferMut.Lock()
+	target.mut.Lock()
+	party.mut.Lock()
+	err := party.moveUser(userID, target)
+	party.mut.Unlock()
+	target.mut.Unlock()
+	transferMut.Unlock()
+	if err != nil {
+		return err
+	}
+
+	usr, err := target.GetUser(userID)
+	if err == nil {
+		err = usr.syncState(ctx)
+		if err != nil {
+			go target.reportError(fmt.Errorf("failed to send state snapshot: %v", err))
+		}
+	}
+	return nil
+}
+
+// Move a user from the party's list to the target's. Both parties must be locked.
+func (party *Party) moveUser(userID string, target *Party) error {
+	usr, ok := party.connectedUsers[userID]
+	if !ok {
+		return ErrNoSuchUser
+	}
+	if usr.muxed {
+		return ErrCannotTransfer
+	}
+	if _, ok := target.connectedUsers[userID]; ok {
+		return fmt.Errorf("%w: %q", ErrUserExists, userID)
+	}
+	if !usr.moveTo(target) {
+		// Already leaving
+		return ErrNoSuchUser
+	}
+	delete(party.connectedUsers, userID)
+	target.connectedUsers[userID] = usr
+
+	// Wake the user's pump to fire leave and join.
+	usr.wake()
+	return nil
+}
+
+// Set the user's party, unless they're leaving.
+func (usr *User) moveTo(target *Party) bool {
+	usr.mut.Lock()
+	defer usr.mut.Unlock()
+	if usr.leaving {
+		return false
+	}
+	usr.party = target
+	return true
+}
+
+// Stop the user being transferred, as they're leaving their current party.
+func (usr *User) leave() {
+	usr.mut.Lock()
+	defer usr.mut.Unlock()
+	usr.leaving = true
+}
+
+// Get the party the user is in.
+func (usr *User) currentParty() *Party {
+	usr.mut.RLock()
+	defer usr.mut.RUnlock()
+	return usr.party
+}
+
+// Get the user's party to check and queue a message for. Transfers aren't followed until it's released.
+func (usr *User) holdParty() *Party {
+	usr.mut.RLock()
+	defer usr.mut.RUnlock()
+	atomic.AddInt32(&usr.held, 1)
+	return usr.party
+}
+
+// Release the party once the message is queued or forbidden, waking the pump if the user was transferred meanwhile.
+func (usr *User) releaseParty(party *Party) {
+	atomic.AddInt32(&usr.held, -1)
+	if usr.currentParty() != party {
+		usr.wake()
+	}
+}
+
+// Wake the user's pump to follow a transfer.
+func (usr *User) wake() {
+	select {
+	case usr.moved <- struct{}{}:
+	default:
+	}
+}
+
+// Follow a transfer once every message sent to the party the user left has been delivered.
+func (usr *User) followTransfer() {
+	// Get the party first, so any message held for a party before it is counted below.
+	to := usr.currentParty()
+	if atomic.LoadInt32(&usr.held) == 0 && len(usr.inbox) == 0 {
+		usr.follow(to)
+	}
+}
+
+/*
+If the party has changed since the user's last message was delivered, fire leave on the
+party they were delivered to, then join on the new party. Only called by the pump, so
+their handler calls are made in order, and through the right party's dispatcher.
+*/
+func (usr *User) follow(to *Party) {
+	from := usr.delivering
+	if from == to {
+		return
+	}
+	usr.delivering = to
+
+	from.subs.publishUser(context.Background(), from.subs.left, usr.ID)
+	from.dispatch(usr, func(handler Handler) {
+		handler.OnLeave(usr.ID)
+	})
+	from.dispatcher.stop(usr)
+	usr.queue = nil
+
+	to.dispatcher.start(usr)
+	to.subs.publishUser(context.Background(), to.subs.joined, usr.ID)
+	to.dispatch(usr, func(handler Handler) {
+		handler.OnJoin(usr.ID)
+	})
+}
@@ -0,0 +1,146 @@
+package sockparty_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"github.com/izzymg/sockparty"
+	"github.com/izzymg/sockparty/sockpartytest"
+)
+
+// Test users move between parties without reconnecting.
+func TestTransfer(t *testing.T) {
+	is := is.New(t)
+
+	lobby := sockparty.New(sockpartytest.SequentialIDs("user"), &sockparty.Options{})
+	game := sockparty.New(generateUID, &sockparty.Options{
+		Dispatch: sockparty.DispatchPerUser,
+	})
+	lobbyRecorder := sockpartytest.Record(lobby)
+	defer lobbyRecorder.Stop()
+	gameRecorder := sockpartytest.Record(game)
+	defer gameRecorder.Stop()
+	handler := &recordingHandler{calls: make(chan string, 16)}
+	game.SetHandler(handler)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	is.NoErr(game.State().Set(ctx, "round", 1))
+
+	c, err := sockpartytest.Dial(lobby)
+	is.NoErr(err)
+	defer c.Close()
+	id, err := lobbyRecorder.ExpectJoin()
+	is.NoErr(err)
+	is.Equal(id, "user1")
+
+	is.True(errors.Is(lobby.Transfer(ctx, "nobody", game), sockparty.ErrNoSuchUser))
+	is.NoErr(lobby.Transfer(ctx, "user1", game))
+	is.True(!lobby.UserExists("user1"))
+	is.True(game.UserExists("user1"))
+
+	// Leave and join fire with the same ID, and the target's state is sent.
+	id, err = lobbyRecorder.ExpectLeave()
+	is.NoErr(err)
+	is.Equal(id, "user1")
+	id, err = gameRecorder.ExpectJoin()
+	is.NoErr(err)
+	is.Equal(id, "user1")
+	_, err = c.Expect(sockparty.EventState)
+	is.NoErr(err)
+
+	// The connection now belongs to the target.
+	is.NoErr(c.Send("move", "up"))
+	incoming, err := gameRecorder.ExpectIncoming()
+	is.NoErr(err)
+	is.Equal(incoming.UserID, "user1")
+	is.NoErr(game.Message(ctx, "user1", &sockparty.Outgoing{Event: "moved"}))
+	_, err = c.Expect("moved")
+	is.NoErr(err)
+
+	// IDs stay unique.
+	clientEnd, serverEnd := sockpartytest.Pipe()
+	go lobby.Join(context.Background(), serverEnd, sockparty.UserInfo{ID: "user1"})
+	_, err = lobbyRecorder.ExpectJoin()
+	is.NoErr(err)
+	is.True(errors.Is(game.Transfer(ctx, "user1", lobby), sockparty.ErrUserExists))
+	is.True(game.UserExists("user1"))
+	is.NoErr(clientEnd.Close(sockparty.StatusNormalClosure, ""))
+	_, err = lobbyRecorder.ExpectLeave()
+	is.NoErr(err)
+
+	// And back again, to a party whose state was never set, which is sent as empty.
+	is.NoErr(game.Transfer(ctx, "user1", lobby))
+	_, err = gameRecorder.ExpectLeave()
+	is.NoErr(err)
+	id, err = lobbyRecorder.ExpectJoin()
+	is.NoErr(err)
+	is.Equal(id, "user1")
+	message, err := c.Expect(sockparty.EventState)
+	is.NoErr(err)
+	var snapshot sockparty.StateSnapshot
+	is.NoErr(message.Decode(&snapshot))
+	is.Equal(snapshot.Version, uint64(0))
+	is.Equal(len(snapshot.State), 0)
+
+	// Leaves whichever party they're in.
+	is.NoErr(c.Close())
+	id, err = lobbyRecorder.ExpectLeave()
+	is.NoErr(err)
+	is.Equal(id, "user1")
+
+	for _, call := range []string{"join", "message move", "leave"} {
+		is.Equal(<-handler.calls, call)
+	}
+}
+
+// Test messages queued before a transfer are delivered to the party they were sent to, before the user leaves it.
+func TestTransferQueued(t *testing.T) {
+	is := is.New(t)
+
+	lobby := sockparty.New(sockpartytest.SequentialIDs("user"), &sockparty.Options{})
+	incoming := make(chan sockparty.Incoming)
+	lobby.SubscribeIncoming(incoming)
+	joined := make(chan string, 1)
+	lobby.SubscribeOnUserJoined(joined)
+	left := make(chan string, 1)
+	lobby.SubscribeOnUserLeft(left)
+	game := sockparty.New(generateUID, &sockparty.Options{})
+	game.RequireRoles("chat", "player")
+	gameRecorder := sockpartytest.Record(game)
+	defer gameRecorder.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	c, err := sockpartytest.Dial(lobby)
+	is.NoErr(err)
+	defer c.Close()
+	is.Equal(<-joined, "user1")
+
+	// The first message is being delivered, the second waits in the inbox.
+	is.NoErr(c.Send("chat", "one"))
+	is.NoErr(c.Send("chat", "two"))
+	time.Sleep(time.Millisecond * 50)
+	is.NoErr(lobby.Transfer(ctx, "user1", game))
+
+	for _, payload := range []string{`"one"`, `"two"`} {
+		select {
+		case message := <-incoming:
+			is.Equal(string(message.Payload), payload)
+		case <-ctx.Done():
+			t.Fatal("Timed out waiting for the lobby's messages")
+		}
+	}
+	is.Equal(<-left, "user1")
+	_, err = gameRecorder.ExpectJoin()
+	is.NoErr(err)
+
+	// The game only receives messages sent after the transfer.
+	is.NoErr(c.Send("move", "up"))
+	message, err := gameRecorder.ExpectIncoming()
+	is.NoErr(err)
+	is.Equal(message.Event, sockparty.Event("move"))
+}
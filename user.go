@@ -4,11 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/time/rate"
-	"nhooyr.io/websocket"
-	"nhooyr.io/websocket/wsjson"
 )
 
 const (
@@ -16,34 +16,83 @@ const (
 	disconnect = "Disconnected."
 )
 
-// newUser creates a new user from a websocket connection. Generates it a new unique ID for lookups.
-func newUser(id string, incoming chan Incoming, connection *websocket.Conn, opts *Options) *user {
-	return &user{
+// newUser creates a new user from a connection. Generates it a new unique ID for lookups.
+func newUser(id string, party *Party, connection Conn, opts *Options) *User {
+	return &User{
 		ID:         id,
-		incoming:   incoming,
+		party:      party,
+		delivering: party,
 		opts:       opts,
 		connection: connection,
+		inbox:      make(chan inboxItem, opts.InboxSize),
+		drained:    make(chan struct{}),
+		uploads:    make(map[string]*upload),
+		high:       make(chan *frame, opts.Lanes.High),
+		normal:     make(chan *frame, opts.Lanes.Normal),
+		low:        make(chan *frame, opts.Lanes.Low),
+		stopped:    make(chan struct{}),
+		moved:      make(chan struct{}, 1),
+		joined:     opts.clock().Now(),
 	}
 }
 
-// user represents a websocket connection from a client.
-type user struct {
-	ID         string
-	Name       string
-	opts       *Options
-	connection *websocket.Conn
-	incoming   chan Incoming
+// User is a handle to a websocket connection from a client, valid while they remain in a party.
+type User struct {
+	ID    string
+	Name  string
+	party *Party
+	opts  *Options
+	// Party the pump delivers the user's messages to, see Transfer
+	delivering *Party
+	moved      chan struct{}
+	// Messages being checked against the party, not yet queued
+	held       int32
+	connection Conn
+	// Handler calls for this user, if not dispatched inline
+	queue chan func()
+	// Incoming messages waiting to be delivered, closed when pump exits
+	inbox   chan inboxItem
+	drained chan struct{}
+	// Chunked uploads in progress, by transfer ID
+	uploads map[string]*upload
+	// Outgoing messages by priority, stopped is closed when the writer exits
+	high    chan *frame
+	normal  chan *frame
+	low     chan *frame
+	stopped chan struct{}
+
+	// Subscribed through a Mux, which pings and rate limits the socket instead
+	muxed bool
+
+	// Bytes written, for compression stats
+	messageBytes uint64
+	joined       time.Time
+
+	// Guards the party, latency and roles
+	mut     sync.RWMutex
+	latency Latency
+	roles   map[Role]bool
+	leaving bool
+
+	// Guards sending state updates, and the version of the state last sent
+	stateMut     sync.Mutex
+	stateSyncing bool
+	stateResync  bool
+	syncedState  *State
+	stateVersion uint64
 }
 
 /*
 Listen begins processing the user's connection, sending information back to
 its given channels. This routine blocks.
 */
-func (usr *user) listen(ctx context.Context, closed chan error) {
+func (usr *User) listen(ctx context.Context, closed chan error) {
 	// Cancel context when one routine exits, causing a cascade cleanup.
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	go usr.pump(ctx)
+
 	/* Don't block on closed channel if no one is listening. */
 	go func() {
 		defer cancel()
@@ -60,14 +109,13 @@ func (usr *user) listen(ctx context.Context, closed chan error) {
 }
 
 /* Handle pings to the user, and drop when the context is canceled. */
-func (usr *user) handleLifecycle(ctx context.Context) error {
-	var ticker *time.Ticker
-	// Don't ping, ugly
-	if usr.opts.PingFrequency > 0 {
-		ticker = time.NewTicker(usr.opts.PingFrequency)
-	} else {
-		ticker = time.NewTicker(time.Second)
-		ticker.Stop()
+func (usr *User) handleLifecycle(ctx context.Context) error {
+	// Never ticks if pings are disabled.
+	var tick <-chan time.Time
+	if usr.opts.PingFrequency > 0 && !usr.muxed {
+		ticker := usr.opts.clock().NewTicker(usr.opts.PingFrequency)
+		defer ticker.Stop()
+		tick = ticker.C()
 	}
 
 	for {
@@ -76,23 +124,34 @@ func (usr *user) handleLifecycle(ctx context.Context) error {
 			// Context dropped (Upgraded request may have been killed)
 			usr.close(timeout)
 			return ctx.Err()
-		case <-ticker.C:
+		case <-tick:
 			// Ping the user and wait for a pong back. Assume dead if no response.
-			err := usr.ping(ctx)
+			rtt, err := usr.ping(ctx)
 			if err != nil {
 				usr.close("Disconnected.")
 				return err
 			}
+			latency := usr.recordLatency(rtt)
+			if usr.opts.ReportLatency {
+				err := usr.write(ctx, &Outgoing{
+					Event:   EventLatency,
+					Payload: latency,
+				})
+				if err != nil {
+					usr.close(disconnect)
+					return err
+				}
+			}
 		}
 	}
 }
 
-/* Listen on all incoming JSON messages from the client, writing them into the users'
-incoming channel. Will die if the context is canceled or read message fails. */
-func (usr *user) handleIncoming(ctx context.Context) error {
+/* Listen on all incoming JSON messages from the client, writing them into the party's
+inbox. Will die if the context is canceled or read message fails. */
+func (usr *User) handleIncoming(ctx context.Context) error {
 
 	limiter := usr.opts.RateLimiter
-	if limiter == nil {
+	if limiter == nil || usr.muxed {
 		limiter = rate.NewLimiter(rate.Inf, 1)
 	}
 
@@ -106,65 +165,227 @@ func (usr *user) handleIncoming(ctx context.Context) error {
 		default:
 		}
 		// Wait for the limiter
-		err := limiter.Wait(ctx)
+		err := waitLimiter(ctx, usr.opts.clock(), limiter)
 		if err != nil {
 			usr.close(timeout)
 			return err
 		}
-		// Read any JSON.
-		message, err := usr.read(ctx)
+		// Read any JSON, or binary.
+		message, binary, err := usr.read(ctx)
 		if err != nil {
 			usr.close(disconnect)
 			return err
 		}
-		if usr.incoming != nil {
-			usr.incoming <- *message
+		atomic.AddUint64(&usr.currentParty().received, 1)
+		received := usr.opts.clock().Now()
+
+		// Binary messages have no event, they go straight to the consumer.
+		if binary != nil {
+			_, err = usr.accept(ctx, inboxItem{binary: binary}, "")
+			if err != nil {
+				usr.close(overloaded)
+				return err
+			}
+			continue
+		}
+
+		// Reply to time syncs directly, they aren't for the consumer.
+		if message.Event == EventTimeSync {
+			err := usr.syncTime(ctx, message, received)
+			if err != nil {
+				usr.close(disconnect)
+				return err
+			}
+			continue
+		}
+		// Resend the state snapshot on request, e.g. after a client misses a patch.
+		if message.Event == EventState {
+			err := usr.resyncState(ctx)
+			if err != nil {
+				usr.close(disconnect)
+				return err
+			}
+			continue
+		}
+		// Reassemble chunked uploads, which are delivered as binary once complete.
+		if message.Event == EventChunk {
+			upload, err := usr.receiveChunk(message)
+			if err != nil {
+				// Bad uploads are discarded, but the user may carry on.
+				go usr.currentParty().reportError(err)
+				continue
+			}
+			if upload == nil {
+				continue
+			}
+			ok, err := usr.accept(ctx, inboxItem{binary: upload}, upload.Event)
+			if err != nil {
+				usr.close(overloaded)
+				return err
+			}
+			if !ok {
+				err := usr.forbid(ctx, upload.Event)
+				if err != nil {
+					usr.close(disconnect)
+					return err
+				}
+			}
+			continue
+		}
+		// Consumer events may require the user have a role.
+		ok, err := usr.accept(ctx, inboxItem{message: message}, message.Event)
+		if err != nil {
+			usr.close(overloaded)
+			return err
+		}
+		if !ok {
+			err := usr.forbid(ctx, message.Event)
+			if err != nil {
+				usr.close(disconnect)
+				return err
+			}
 		}
 	}
 }
 
+/*
+Queue a message for the user's party, returning false if the party forbids the event.
+Binary messages have no event to check. The party is held until the message is queued,
+so if the user is transferred meanwhile, it's delivered to that party before they leave it.
+*/
+func (usr *User) accept(ctx context.Context, item inboxItem, event Event) (bool, error) {
+	party := usr.holdParty()
+	defer usr.releaseParty(party)
+	if event != "" && !party.permitted(usr, event) {
+		return false, nil
+	}
+	item.party = party
+	return true, usr.enqueue(ctx, item)
+}
+
 // close ends the users connection, causing a cascade cleanup.
-func (usr *user) close(reason string) error {
-	err := usr.connection.Close(websocket.StatusNormalClosure, reason)
+func (usr *User) close(reason string) error {
+	err := usr.connection.Close(StatusNormalClosure, reason)
 	if err != nil {
 		return fmt.Errorf("Closing user connection failed: %w", err)
 	}
 	return nil
 }
 
-// write sends a message to the user.
-func (usr *user) write(ctx context.Context, message *Outgoing) error {
-	err := wsjson.Write(ctx, usr.connection, message)
+// kick ends the user's connection for breaking the party's rules.
+func (usr *User) kick(reason string) error {
+	err := usr.connection.Close(StatusPolicyViolation, reason)
 	if err != nil {
-		return fmt.Errorf("Write JSON to user failed: %w", err)
+		return fmt.Errorf("Kicking user failed: %w", err)
 	}
 	return nil
 }
 
-// Blocks until a message comes through from the connection and reads it.
-func (usr *user) read(ctx context.Context) (*Incoming, error) {
+// write sends a message to the user.
+func (usr *User) write(ctx context.Context, message *Outgoing) error {
+	prepared, err := NewPreparedMessage(message)
+	if err != nil {
+		return err
+	}
+	return usr.writePrepared(ctx, prepared)
+}
+
+// writeBinary sends a binary message to the user.
+func (usr *User) writeBinary(ctx context.Context, data []byte) error {
+	return usr.send(ctx, PriorityNormal, MessageBinary, data)
+}
+
+// writePrepared sends an already encoded message to the user.
+func (usr *User) writePrepared(ctx context.Context, message *PreparedMessage) error {
+	return usr.send(ctx, message.priority, MessageText, message.data)
+}
+
+/* Blocks until a message comes through from the connection and reads it.
+Text messages are decoded as JSON, binary messages are returned as is. */
+func (usr *User) read(ctx context.Context) (*Incoming, *IncomingBinary, error) {
+	typ, data, err := usr.connection.ReadMessage(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Read from user failed: %w", err)
+	}
+	if typ == MessageBinary {
+		return nil, &IncomingBinary{
+			UserID: usr.ID,
+			Data:   data,
+		}, nil
+	}
 
-	var payload json.RawMessage
 	im := &Incoming{
-		UserID:  usr.ID,
-		Payload: payload,
+		UserID: usr.ID,
+	}
+	err = json.Unmarshal(data, im)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Read JSON from user failed: %w", err)
 	}
+	return im, nil, nil
+}
 
-	err := wsjson.Read(ctx, usr.connection, im)
+// Reply to a time sync request with the time it was received and the time it was replied to.
+func (usr *User) syncTime(ctx context.Context, message *Incoming, received time.Time) error {
+	ts := TimeSync{}
+	err := json.Unmarshal(message.Payload, &ts)
 	if err != nil {
-		return nil, fmt.Errorf("Read JSON from user failed: %w", err)
+		return fmt.Errorf("Invalid time sync payload: %w", err)
 	}
+	ts.ServerReceive = UnixMillis(received)
+	ts.ServerSend = UnixMillis(usr.opts.clock().Now())
+	return usr.write(ctx, &Outgoing{
+		Event:   EventTimeSync,
+		Payload: ts,
+	})
+}
 
-	return im, nil
+// Tell the user they don't have permission to send an event.
+func (usr *User) forbid(ctx context.Context, event Event) error {
+	return usr.write(ctx, &Outgoing{
+		Event:   EventForbidden,
+		Payload: &Forbidden{Event: event},
+	})
 }
 
-// Blocks until user responds with a pong/context cancels
-func (usr *user) ping(ctx context.Context) error {
-	ctx, cancel := context.WithTimeout(ctx, usr.opts.PingTimeout)
+// Blocks until user responds with a pong/context cancels, returning the round trip time.
+func (usr *User) ping(ctx context.Context) (time.Duration, error) {
+	clock := usr.opts.clock()
+	ctx, expired, cancel := withClockTimeout(ctx, clock, usr.opts.PingTimeout)
 	defer cancel()
+	start := clock.Now()
 	err := usr.connection.Ping(ctx)
 	if err != nil {
-		return fmt.Errorf("Ping failed: %w", err)
+		select {
+		case <-expired:
+			return 0, fmt.Errorf("Ping failed: %w", context.DeadlineExceeded)
+		default:
+		}
+		return 0, fmt.Errorf("Ping failed: %w", err)
 	}
-	return nil
+	return clock.Now().Sub(start), nil
+}
+
+// Subprotocol returns the subprotocol negotiated with the user, empty if none.
+func (usr *User) Subprotocol() string {
+	return usr.connection.Subprotocol()
+}
+
+// Joined returns when the user joined the party.
+func (usr *User) Joined() time.Time {
+	return usr.joined
+}
+
+// Latency returns the user's round trip time measurements, zero if they haven't been pinged.
+func (usr *User) Latency() Latency {
+	usr.mut.RLock()
+	defer usr.mut.RUnlock()
+	return usr.latency
+}
+
+// Add a round trip time sample to the user's latency, returning the result.
+func (usr *User) recordLatency(rtt time.Duration) Latency {
+	usr.mut.Lock()
+	defer usr.mut.Unlock()
+	usr.latency = usr.latency.add(rtt)
+	return usr.latency
 }